@@ -2,10 +2,12 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"fingertip/internal/resolvers"
 	"fmt"
 	"github.com/buffrr/letsdane"
 	"io/ioutil"
@@ -33,6 +35,24 @@ type App struct {
 
 	Store *Store
 	Debug Debugger
+
+	// DNS-over-HTTPS handler served on /dns-query
+	DoH http.Handler
+
+	// resolves a name recording each step
+	// shown on /trace
+	Trace func(ctx context.Context, name string, qtype uint16) *resolvers.Trace
+
+	// reports whether looking up name waits for
+	// hnsd to sync, every name does if nil
+	NeedsSync func(name string) bool
+
+	// reloads response policy zones
+	// on POST /rpz/reload
+	ReloadPolicies func() error
+
+	// served on /metrics
+	Metrics *resolvers.Metrics
 }
 
 func getOrCreateDir() (string, error) {
@@ -192,6 +212,22 @@ type contentHandler struct {
 	config *App
 }
 
+// sameOrigin reports whether req comes from fingertip's own pages.
+// Browsers send Origin or Referer with cross-site POST requests,
+// other clients like curl may send neither.
+func (c *contentHandler) sameOrigin(req *http.Request) bool {
+	base := GetProxyURL(c.config.ProxyAddr)
+	if origin := req.Header.Get("Origin"); origin != "" {
+		return origin == base
+	}
+
+	if referer := req.Header.Get("Referer"); referer != "" {
+		return referer == base || strings.HasPrefix(referer, base+"/")
+	}
+
+	return true
+}
+
 func (c *contentHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == "" || req.URL.Path == "/" {
 		url := GetProxyURL(c.config.ProxyAddr)
@@ -202,6 +238,7 @@ func (c *contentHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			Version:       c.config.Version,
 			NavSetupLink:  url + "/setup",
 			NavStatusLink: url,
+			NavTraceLink:  url + "/trace",
 		})
 		return
 	}
@@ -215,6 +252,7 @@ func (c *contentHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			Version:       c.config.Version,
 			NavSetupLink:  url + "/setup",
 			NavStatusLink: url,
+			NavTraceLink:  url + "/trace",
 		})
 		return
 	}
@@ -241,6 +279,81 @@ func (c *contentHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.URL.Path == "/dns-query" {
+		if c.config.DoH == nil {
+			http.NotFound(rw, req)
+			return
+		}
+
+		c.config.DoH.ServeHTTP(rw, req)
+		return
+	}
+
+	if req.URL.Path == "/trace" || req.URL.Path == "/trace.json" {
+		if c.config.Trace == nil {
+			http.NotFound(rw, req)
+			return
+		}
+
+		if req.URL.Path == "/trace.json" {
+			c.serveTraceJSON(rw, req)
+			return
+		}
+
+		c.serveTracePage(rw, req)
+		return
+	}
+
+	if req.URL.Path == "/sync" {
+		c.serveSyncPage(rw, req)
+		return
+	}
+
+	if req.URL.Path == "/sync.json" {
+		c.serveSyncJSON(rw, req)
+		return
+	}
+
+	if req.URL.Path == "/metrics" {
+		if c.config.Metrics == nil {
+			http.NotFound(rw, req)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.config.Metrics.WritePrometheus(rw)
+		return
+	}
+
+	if req.URL.Path == "/rpz/reload" {
+		if c.config.ReloadPolicies == nil {
+			http.NotFound(rw, req)
+			return
+		}
+
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !c.sameOrigin(req) {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		result := map[string]string{"status": "ok"}
+		if err := c.config.ReloadPolicies(); err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			result = map[string]string{"status": "error", "error": err.Error()}
+		}
+
+		data, _ := json.Marshal(result)
+		rw.Write(data)
+		return
+	}
+
 	if req.URL.Path == "/proxy.pac" {
 		rw.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
 		var names []string
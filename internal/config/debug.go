@@ -29,6 +29,9 @@ type Debugger struct {
 	dnsProbeErr        error
 	checkCert          func() bool
 	checkSynced        func() bool
+	cacheStats         func() map[string]resolvers.CacheStats
+	extensionStatus    func() map[string]resolvers.ExtensionStatus
+	rpzStats           func() map[string]resolvers.RPZStats
 
 	blockHeight uint64
 
@@ -46,6 +49,10 @@ type DebugInfo struct {
 	DNSReachable       bool   `json:"dnsTestPassed"`
 	DNSProbeInProgress bool   `json:"dnsTestInProgress"`
 	DNSProbeErr        string `json:"dnsTestError"`
+
+	Caches     map[string]resolvers.CacheStats      `json:"caches"`
+	Extensions map[string]resolvers.ExtensionStatus `json:"extensions"`
+	RPZ        map[string]resolvers.RPZStats        `json:"rpz,omitempty"`
 }
 
 // Check if udp over port 53 is reachable
@@ -157,6 +164,27 @@ func (d *Debugger) SetCheckSynced(s func() bool) {
 	d.checkSynced = s
 }
 
+func (d *Debugger) SetCacheStats(s func() map[string]resolvers.CacheStats) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.cacheStats = s
+}
+
+func (d *Debugger) SetRPZStats(s func() map[string]resolvers.RPZStats) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.rpzStats = s
+}
+
+func (d *Debugger) SetExtensionStatus(s func() map[string]resolvers.ExtensionStatus) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.extensionStatus = s
+}
+
 func (d *Debugger) NewProbe() {
 	d.Lock()
 	d.proxyProbeReached = false
@@ -174,6 +202,17 @@ func (d *Debugger) NewProbe() {
 }
 
 func (d *Debugger) GetInfo() DebugInfo {
+	// health checks may be slow
+	// don't hold the lock while running them
+	d.RLock()
+	extensionStatus := d.extensionStatus
+	d.RUnlock()
+
+	var extensions map[string]resolvers.ExtensionStatus
+	if extensionStatus != nil {
+		extensions = extensionStatus()
+	}
+
 	d.RLock()
 	defer d.RUnlock()
 
@@ -181,6 +220,17 @@ func (d *Debugger) GetInfo() DebugInfo {
 	if d.dnsProbeErr != nil {
 		err = d.dnsProbeErr.Error()
 	}
+
+	var caches map[string]resolvers.CacheStats
+	if d.cacheStats != nil {
+		caches = d.cacheStats()
+	}
+
+	var rpz map[string]resolvers.RPZStats
+	if d.rpzStats != nil {
+		rpz = d.rpzStats()
+	}
+
 	return DebugInfo{
 		BlockHeight:        d.blockHeight,
 		ProbeURL:           "http://" + d.proxyProbeDomain,
@@ -190,6 +240,9 @@ func (d *Debugger) GetInfo() DebugInfo {
 		DNSReachable:       !d.dnsProbeInProgress && d.dnsProbeErr == nil,
 		DNSProbeErr:        err,
 		DNSProbeInProgress: d.dnsProbeInProgress,
+		Caches:             caches,
+		Extensions:         extensions,
+		RPZ:                rpz,
 	}
 }
 
@@ -8,6 +8,7 @@ import (
 type onBoardingTmplData struct {
 	NavSetupLink  string
 	NavStatusLink string
+	NavTraceLink  string
 	CertPath      string
 	CertLink      string
 	PACLink       string
@@ -20,8 +21,16 @@ var statusPage string
 //go:embed pages/setup.html
 var setupPage string
 
+//go:embed pages/trace.html
+var tracePage string
+
+//go:embed pages/sync.html
+var syncPage string
+
 var setupTmpl *template.Template
 var statusTmpl *template.Template
+var traceTmpl *template.Template
+var syncTmpl *template.Template
 
 func init() {
 	var err error
@@ -31,4 +40,10 @@ func init() {
 	if statusTmpl, err = template.New("status").Parse(statusPage); err != nil {
 		panic(err)
 	}
+	if traceTmpl, err = template.New("trace").Parse(tracePage); err != nil {
+		panic(err)
+	}
+	if syncTmpl, err = template.New("sync").Parse(syncPage); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// seconds between reloads of the sync page
+const syncRefreshInterval = 3
+
+type syncTmplData struct {
+	NavSetupLink  string
+	NavStatusLink string
+	NavTraceLink  string
+	Version       string
+
+	Synced  bool
+	Height  uint64
+	URL     string
+	Refresh int
+}
+
+// SyncStatus returns whether hnsd is synced and the current block height
+func (d *Debugger) SyncStatus() (bool, uint64) {
+	d.RLock()
+	defer d.RUnlock()
+
+	synced := d.checkSynced == nil || d.checkSynced()
+	return synced, d.blockHeight
+}
+
+// syncReturnURL only allows going back to http(s) urls
+func syncReturnURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+
+	return u.String()
+}
+
+func (c *contentHandler) serveSyncJSON(rw http.ResponseWriter, req *http.Request) {
+	synced, height := c.config.Debug.SyncStatus()
+
+	rw.Header().Set("Content-Type", "application/json")
+	data, _ := json.Marshal(map[string]interface{}{
+		"synced": synced,
+		"height": height,
+	})
+	rw.Write(data)
+}
+
+func (c *contentHandler) serveSyncPage(rw http.ResponseWriter, req *http.Request) {
+	synced, height := c.config.Debug.SyncStatus()
+	returnURL := syncReturnURL(req.URL.Query().Get("url"))
+
+	if synced && returnURL != "" {
+		http.Redirect(rw, req, returnURL, http.StatusFound)
+		return
+	}
+
+	base := GetProxyURL(c.config.ProxyAddr)
+	syncTmpl.Execute(rw, syncTmplData{
+		NavSetupLink:  base + "/setup",
+		NavStatusLink: base,
+		NavTraceLink:  base + "/trace",
+		Version:       c.config.Version,
+		Synced:        synced,
+		Height:        height,
+		URL:           returnURL,
+		Refresh:       syncRefreshInterval,
+	})
+}
+
+// needsSync reports whether opening host has to wait for hnsd.
+// IP addresses, local and forwarded names don't.
+func (c *App) needsSync(host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+
+	return c.NeedsSync == nil || c.NeedsSync(dns.Fqdn(host))
+}
+
+// WaitForSync sends pages opened over plain http while syncing
+// to the sync page which returns to them once synced instead of
+// showing a lookup error. HTTPS requests can't be redirected
+// and wait in the resolver instead.
+func (c *App) WaitForSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || req.URL.Scheme != "http" ||
+			!strings.Contains(req.Header.Get("Accept"), "text/html") {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		base := GetProxyURL(c.ProxyAddr)
+		if synced, _ := c.Debug.SyncStatus(); synced || "http://"+req.URL.Host == base ||
+			!c.needsSync(req.URL.Hostname()) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		to := base + "/sync?url=" + url.QueryEscape(req.URL.String())
+		http.Redirect(rw, req, to, http.StatusFound)
+	})
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fingertip/internal/resolvers"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const traceTimeout = 15 * time.Second
+
+type traceTmplData struct {
+	NavSetupLink  string
+	NavStatusLink string
+	NavTraceLink  string
+	JSONLink      string
+	Version       string
+
+	Name  string
+	Type  string
+	Trace *resolvers.Trace
+	Error string
+}
+
+// parseTraceQuery reads name and type
+// type defaults to A if not specified
+func parseTraceQuery(q url.Values) (string, uint16, error) {
+	name := strings.TrimSpace(q.Get("name"))
+	if name == "" {
+		return "", 0, fmt.Errorf("name is required")
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", 0, fmt.Errorf("invalid name %s", name)
+	}
+
+	t := strings.ToUpper(strings.TrimSpace(q.Get("type")))
+	if t == "" {
+		return name, dns.TypeA, nil
+	}
+
+	qtype, ok := dns.StringToType[t]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown type %s", t)
+	}
+
+	return name, qtype, nil
+}
+
+func (c *contentHandler) runTrace(req *http.Request, name string, qtype uint16) *resolvers.Trace {
+	ctx, cancel := context.WithTimeout(req.Context(), traceTimeout)
+	defer cancel()
+
+	return c.config.Trace(ctx, name, qtype)
+}
+
+func (c *contentHandler) serveTraceJSON(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	name, qtype, err := parseTraceQuery(req.URL.Query())
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		rw.Write(data)
+		return
+	}
+
+	data, _ := json.Marshal(c.runTrace(req, name, qtype))
+	rw.Write(data)
+}
+
+func (c *contentHandler) serveTracePage(rw http.ResponseWriter, req *http.Request) {
+	base := GetProxyURL(c.config.ProxyAddr)
+	q := req.URL.Query()
+	data := traceTmplData{
+		NavSetupLink:  base + "/setup",
+		NavStatusLink: base,
+		NavTraceLink:  base + "/trace",
+		JSONLink:      base + "/trace.json?" + q.Encode(),
+		Version:       c.config.Version,
+		Name:          q.Get("name"),
+		Type:          q.Get("type"),
+	}
+
+	// empty form
+	if data.Name == "" {
+		traceTmpl.Execute(rw, data)
+		return
+	}
+
+	name, qtype, err := parseTraceQuery(q)
+	if err != nil {
+		data.Error = err.Error()
+		traceTmpl.Execute(rw, data)
+		return
+	}
+
+	data.Trace = c.runTrace(req, name, qtype)
+	traceTmpl.Execute(rw, data)
+}
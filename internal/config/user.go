@@ -3,10 +3,12 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fingertip/internal/resolvers"
 	"fmt"
 	"github.com/spf13/viper"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 const (
@@ -22,6 +24,72 @@ type User struct {
 	RootAddr         string `mapstructure:"ROOT_ADDRESS"`
 	RecursiveAddr    string `mapstructure:"RECURSIVE_ADDRESS"`
 	EthereumEndpoint string `mapstructure:"ETHEREUM_ENDPOINT"`
+	// optional DNS server address
+	// disabled if empty
+	DNSAddr string `mapstructure:"DNS_ADDRESS"`
+
+	// max entries per resolver cache
+	TLDCacheSize         int `mapstructure:"TLD_CACHE_SIZE"`
+	NegativeTLDCacheSize int `mapstructure:"NEGATIVE_TLD_CACHE_SIZE"`
+	DNSKEYCacheSize      int `mapstructure:"DNSKEY_CACHE_SIZE"`
+	ENSResolverCacheSize int `mapstructure:"ENS_RESOLVER_CACHE_SIZE"`
+	ENSQueryCacheSize    int `mapstructure:"ENS_QUERY_CACHE_SIZE"`
+	AnswerCacheSize      int `mapstructure:"ANSWER_CACHE_SIZE"`
+
+	// how long expired answers may be served
+	// if a fresh lookup fails zero to disable
+	MaxStale time.Duration `mapstructure:"SERVE_STALE_MAX"`
+
+	// save resolver caches to disk
+	// to reuse them after a restart
+	PersistCache bool `mapstructure:"PERSIST_CACHE"`
+
+	// hip-5 extensions that shouldn't be used e.g. _eth
+	DisabledExtensions []string `mapstructure:"DISABLED_EXTENSIONS"`
+
+	// off, relaxed or strict
+	QNAMEMinimisation string `mapstructure:"QNAME_MINIMISATION"`
+
+	// limits for resolving a single name
+	// zero for no limit
+	MaxQueryTime     time.Duration `mapstructure:"MAX_QUERY_TIME"`
+	MaxQueryUpstream int           `mapstructure:"MAX_QUERY_UPSTREAM"`
+
+	// how long queries made while syncing wait
+	// for hnsd zero to fail right away
+	SyncWait      time.Duration `mapstructure:"SYNC_WAIT"`
+	SyncWaitQueue int           `mapstructure:"SYNC_WAIT_QUEUE"`
+
+	// answers from the local zone file
+	// are insecure unless trusted
+	LocalZoneTrusted bool `mapstructure:"LOCAL_ZONE_TRUSTED"`
+
+	// response policy zone files in
+	// the config dir applied in order
+	RPZZones []string `mapstructure:"RPZ_ZONES"`
+
+	// suffix=server rules and a file in the config
+	// dir with DS records to validate them against
+	ForwardZones        []string `mapstructure:"FORWARD_ZONES"`
+	ForwardTrustAnchors string   `mapstructure:"FORWARD_TRUST_ANCHORS"`
+}
+
+func (u *User) CacheConfig() resolvers.CacheConfig {
+	return resolvers.CacheConfig{
+		TLD:         u.TLDCacheSize,
+		NegativeTLD: u.NegativeTLDCacheSize,
+		DNSKEY:      u.DNSKEYCacheSize,
+		ENSResolver: u.ENSResolverCacheSize,
+		ENSQuery:    u.ENSQueryCacheSize,
+		Answers:     u.AnswerCacheSize,
+	}
+}
+
+func (u *User) QueryBudget() resolvers.QueryBudget {
+	return resolvers.QueryBudget{
+		MaxQueries: u.MaxQueryUpstream,
+		MaxTime:    u.MaxQueryTime,
+	}
 }
 
 // Stored config
@@ -92,6 +160,25 @@ func ReadUserConfig(path string) (config User, err error) {
 	viper.SetDefault("ROOT_ADDRESS", DefaultRootAddr)
 	viper.SetDefault("RECURSIVE_ADDRESS", DefaultRecursiveAddr)
 	viper.SetDefault("ETHEREUM_ENDPOINT", DefaultEthereumEndpoint)
+	viper.SetDefault("DNS_ADDRESS", "")
+	viper.SetDefault("TLD_CACHE_SIZE", resolvers.DefaultCacheConfig.TLD)
+	viper.SetDefault("NEGATIVE_TLD_CACHE_SIZE", resolvers.DefaultCacheConfig.NegativeTLD)
+	viper.SetDefault("DNSKEY_CACHE_SIZE", resolvers.DefaultCacheConfig.DNSKEY)
+	viper.SetDefault("ENS_RESOLVER_CACHE_SIZE", resolvers.DefaultCacheConfig.ENSResolver)
+	viper.SetDefault("ENS_QUERY_CACHE_SIZE", resolvers.DefaultCacheConfig.ENSQuery)
+	viper.SetDefault("ANSWER_CACHE_SIZE", resolvers.DefaultCacheConfig.Answers)
+	viper.SetDefault("SERVE_STALE_MAX", resolvers.DefaultMaxStale)
+	viper.SetDefault("PERSIST_CACHE", true)
+	viper.SetDefault("DISABLED_EXTENSIONS", []string{})
+	viper.SetDefault("QNAME_MINIMISATION", "relaxed")
+	viper.SetDefault("MAX_QUERY_TIME", resolvers.DefaultQueryBudget.MaxTime)
+	viper.SetDefault("MAX_QUERY_UPSTREAM", resolvers.DefaultQueryBudget.MaxQueries)
+	viper.SetDefault("SYNC_WAIT", resolvers.DefaultSyncWait)
+	viper.SetDefault("SYNC_WAIT_QUEUE", resolvers.DefaultSyncWaitQueue)
+	viper.SetDefault("LOCAL_ZONE_TRUSTED", false)
+	viper.SetDefault("RPZ_ZONES", []string{})
+	viper.SetDefault("FORWARD_ZONES", []string{})
+	viper.SetDefault("FORWARD_TRUST_ANCHORS", "")
 
 	err = viper.ReadInConfig()
 	if err != nil {
@@ -0,0 +1,76 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var errBudgetExceeded = errors.New("query budget exceeded")
+
+// QueryBudget limits the work done to answer a single
+// query including CNAME chains, delegations and nameserver
+// address lookups so pathological names fail fast
+type QueryBudget struct {
+	// max queries sent to the root, nameservers,
+	// the stub resolver or ethereum. zero for no limit
+	MaxQueries int
+	// max wall time zero for no limit
+	MaxTime time.Duration
+}
+
+var DefaultQueryBudget = QueryBudget{
+	MaxQueries: 64,
+	MaxTime:    10 * time.Second,
+}
+
+type budgetKey struct{}
+
+type queryBudget struct {
+	max  int32
+	used int32
+}
+
+// withBudget returns a context limited by b unless ctx
+// already carries a budget from an outer query in which
+// case the work is counted against that one. The returned
+// budget is nil for nested queries.
+func withBudget(ctx context.Context, b QueryBudget) (context.Context, context.CancelFunc, *queryBudget) {
+	if _, ok := ctx.Value(budgetKey{}).(*queryBudget); ok {
+		return ctx, func() {}, nil
+	}
+
+	cancel := func() {}
+	if b.MaxTime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, b.MaxTime)
+	}
+
+	qb := &queryBudget{max: int32(b.MaxQueries)}
+	return context.WithValue(ctx, budgetKey{}, qb), cancel, qb
+}
+
+// spendQuery counts an upstream query against the budget
+// in ctx and returns an error if it's used up
+func spendQuery(ctx context.Context) error {
+	qb, ok := ctx.Value(budgetKey{}).(*queryBudget)
+	if !ok {
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: out of time", errBudgetExceeded)
+	}
+
+	if qb.max > 0 && atomic.AddInt32(&qb.used, 1) > qb.max {
+		return fmt.Errorf("%w: more than %d upstream queries", errBudgetExceeded, qb.max)
+	}
+
+	return nil
+}
+
+// SetQueryBudget sets the limits for each query
+func (h *HIP5Resolver) SetQueryBudget(b QueryBudget) {
+	h.budget = b
+}
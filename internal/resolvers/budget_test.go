@@ -0,0 +1,78 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHIP5QueryBudget(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			if name != "ns.example." {
+				return &resolver.DNSResult{Err: resolver.ErrServFail}
+			}
+
+			res := &resolver.DNSResult{}
+			if qtype == dns.TypeA {
+				res.Records = []dns.RR{testRR("ns.example. 300 IN A 127.0.0.1")}
+			}
+			return res
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.SetQNAMEMinimisation(QNAMEMinimisationOff)
+	h.SetQueryBudget(QueryBudget{MaxQueries: 5, MaxTime: time.Minute})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS budget._example.")})
+
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		if qname == "slow.forever." {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return []dns.RR{testRR("forever. 300 IN NS ns.example.")}, nil
+	})
+
+	// every name is a CNAME to the next one
+	var exchanges int32
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		n := atomic.AddInt32(&exchanges, 1)
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = []dns.RR{testRR(fmt.Sprintf("%s 300 IN CNAME c%d.forever.", m.Question[0].Name, n))}
+		return r, time.Millisecond, nil
+	}
+
+	res := h.query(context.Background(), "chain.forever.", dns.TypeA)
+	if !errors.Is(res.Err, errBudgetExceeded) {
+		t.Fatalf("got err = %v, want %v", res.Err, errBudgetExceeded)
+	}
+
+	if n := atomic.LoadInt32(&exchanges); n > 5 {
+		t.Fatalf("got %d exchanges, want at most 5", n)
+	}
+
+	h.SetQueryBudget(QueryBudget{MaxTime: 50 * time.Millisecond})
+
+	start := time.Now()
+	res = h.query(context.Background(), "slow.forever.", dns.TypeA)
+	if !errors.Is(res.Err, errBudgetExceeded) || !strings.Contains(res.Err.Error(), "took longer") {
+		t.Fatalf("got err = %v, want time budget error", res.Err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got elapsed = %v, want less than 1s", elapsed)
+	}
+}
@@ -1,58 +1,328 @@
 package resolvers
 
 import (
+	"container/list"
+	"context"
 	"sync"
 	"time"
 )
 
+const (
+	sweepInterval = time.Minute
+	// entries are prefetched when accessed
+	// in the last 10% of their lifetime
+	prefetchWindow = 10
+	// min hits before an entry is worth prefetching
+	prefetchMinHits = 3
+	prefetchTimeout = 10 * time.Second
+)
+
 type entry struct {
 	msg interface{}
 	ttl time.Time
 }
 
+// CacheStats counters exposed for debugging
+type CacheStats struct {
+	Size       int    `json:"size"`
+	Capacity   int    `json:"capacity"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	Expired    uint64 `json:"expired"`
+	StaleHits  uint64 `json:"staleHits"`
+	Prefetches uint64 `json:"prefetches"`
+}
+
+// CacheConfig sets the max number of entries per cache
+type CacheConfig struct {
+	TLD int
+	// TLDs without hip-5 records
+	NegativeTLD int
+	DNSKEY      int
+	ENSResolver int
+	// applies to each record type cache
+	ENSQuery int
+	// final hip-5 answers kept for serve-stale
+	Answers int
+}
+
+var DefaultCacheConfig = CacheConfig{
+	TLD:         30,
+	NegativeTLD: 500,
+	DNSKEY:      200,
+	ENSResolver: 200,
+	ENSQuery:    500,
+	Answers:     1000,
+}
+
+type cacheItem struct {
+	key string
+	*entry
+
+	stored      time.Time
+	hits        int
+	prefetching bool
+}
+
+// prefetchFunc refreshes an entry that is about to expire
+type prefetchFunc func(ctx context.Context, key string, e *entry)
+
+// cache is a bounded LRU with TTL expiry.
+// Expired entries are removed on access
+// and by a background sweeper once they
+// are older than the max stale window.
 type cache struct {
-	m    map[string]*entry
-	maxN int
+	m        map[string]*list.Element
+	ll       *list.List
+	maxN     int
+	maxStale time.Duration
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	expired   uint64
+	staleHits uint64
 
-	sync.RWMutex
+	prefetch   prefetchFunc
+	prefetches uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+	sync.Mutex
 }
 
 func newCache(maxN int) (m *cache) {
-	return &cache{m: make(map[string]*entry), maxN: maxN}
+	if maxN < 1 {
+		maxN = 1
+	}
+
+	c := &cache{
+		m:    make(map[string]*list.Element),
+		ll:   list.New(),
+		maxN: maxN,
+		done: make(chan struct{}),
+	}
+
+	go c.sweepLoop()
+	return c
 }
 
 func (c *cache) set(key string, item *entry) {
 	c.Lock()
 	defer c.Unlock()
 
-	if c.maxN == len(c.m) {
-		for k := range c.m {
-			delete(c.m, k)
-			break
-		}
+	if el, ok := c.m[key]; ok {
+		// keep hits to remember popular entries
+		i := el.Value.(*cacheItem)
+		i.entry = item
+		i.stored = time.Now()
+		i.prefetching = false
+		c.ll.MoveToFront(el)
+		return
 	}
 
-	c.m[key] = item
+	if c.ll.Len() >= c.maxN {
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+
+	c.m[key] = c.ll.PushFront(&cacheItem{key: key, entry: item, stored: time.Now()})
 }
 
+// get returns a fresh entry for key
+// expired entries count as misses
 func (c *cache) get(key string) (*entry, bool) {
-	c.RLock()
-	defer c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.m[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	item := el.Value.(*cacheItem)
+	if now := time.Now(); now.After(item.ttl) {
+		if now.After(item.ttl.Add(c.maxStale)) {
+			c.removeElement(el)
+			c.expired++
+		}
+		c.misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+	item.hits++
+	c.maybePrefetch(item)
+	return item.entry, true
+}
+
+// setPrefetch enables refreshing popular
+// entries shortly before they expire
+func (c *cache) setPrefetch(fn prefetchFunc) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.prefetch = fn
+}
+
+// maybePrefetch must be called with the lock held
+func (c *cache) maybePrefetch(item *cacheItem) {
+	if c.prefetch == nil || item.prefetching || item.hits < prefetchMinHits {
+		return
+	}
+
+	lifetime := item.ttl.Sub(item.stored)
+	if time.Until(item.ttl) > lifetime/prefetchWindow {
+		return
+	}
+
+	item.prefetching = true
+	c.prefetches++
+
+	fn, key, e := c.prefetch, item.key, item.entry
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		defer cancel()
+		fn(ctx, key, e)
+	}()
+}
+
+// getStale returns an expired entry for key
+// that is still within the max stale window
+func (c *cache) getStale(key string) (*entry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := el.Value.(*cacheItem)
+	if time.Now().After(item.ttl.Add(c.maxStale)) {
+		return nil, false
+	}
 
-	i, ok := c.m[key]
-	return i, ok
+	c.staleHits++
+	return item.entry, true
+}
+
+// setMaxStale sets how long expired
+// entries are kept for getStale
+func (c *cache) setMaxStale(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.maxStale = d
+}
+
+func (c *cache) maxStaleWindow() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.maxStale
 }
 
 func (c *cache) remove(key string) {
 	c.Lock()
 	defer c.Unlock()
 
-	delete(c.m, key)
+	if el, ok := c.m[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.m, el.Value.(*cacheItem).key)
 }
 
 func (c *cache) len() int {
-	c.RLock()
-	defer c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *cache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.m = make(map[string]*list.Element)
+	c.ll.Init()
+}
+
+// snapshot returns a copy of all entries
+// least recently used first
+func (c *cache) snapshot() []cacheItem {
+	c.Lock()
+	defer c.Unlock()
 
-	return len(c.m)
+	items := make([]cacheItem, 0, c.ll.Len())
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		i := el.Value.(*cacheItem)
+		items = append(items, cacheItem{key: i.key, entry: i.entry})
+	}
+
+	return items
+}
+
+// sweep removes all expired entries
+func (c *cache) sweep() {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*cacheItem).ttl.Add(c.maxStale)) {
+			c.removeElement(el)
+			c.expired++
+		}
+		el = prev
+	}
+}
+
+func (c *cache) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close stops the background sweeper
+func (c *cache) close() {
+	if c == nil {
+		return
+	}
+
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *cache) stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return CacheStats{
+		Size:       c.ll.Len(),
+		Capacity:   c.maxN,
+		Hits:       c.hits,
+		Misses:     c.misses,
+		Evictions:  c.evictions,
+		Expired:    c.expired,
+		StaleHits:  c.staleHits,
+		Prefetches: c.prefetches,
+	}
 }
@@ -0,0 +1,103 @@
+package resolvers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacheLRU(t *testing.T) {
+	c := newCache(2)
+	defer c.close()
+
+	fresh := func(v string) *entry {
+		return &entry{msg: v, ttl: time.Now().Add(time.Hour)}
+	}
+
+	c.set("a", fresh("a"))
+	c.set("b", fresh("b"))
+
+	// touch a so b becomes the least recently used
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("want a in cache")
+	}
+
+	c.set("c", fresh("c"))
+	if _, ok := c.get("b"); ok {
+		t.Fatal("want b evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("want a in cache")
+	}
+
+	stats := c.stats()
+	if stats.Size != 2 || stats.Evictions != 1 || stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("got stats = %+v", stats)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newCache(10)
+	defer c.close()
+
+	c.set("expired", &entry{msg: 1, ttl: time.Now().Add(-time.Second)})
+	c.set("swept", &entry{msg: 2, ttl: time.Now().Add(-time.Second)})
+	c.set("fresh", &entry{msg: 3, ttl: time.Now().Add(time.Hour)})
+
+	if _, ok := c.get("expired"); ok {
+		t.Fatal("want expired entry to be a miss")
+	}
+
+	c.sweep()
+	if c.len() != 1 {
+		t.Fatalf("got len = %d, want 1", c.len())
+	}
+
+	if stats := c.stats(); stats.Expired != 2 {
+		t.Fatalf("got expired = %d, want 2", stats.Expired)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := newCache(10)
+	defer c.close()
+
+	prefetched := make(chan string, 1)
+	c.setPrefetch(func(ctx context.Context, key string, e *entry) {
+		prefetched <- key
+	})
+
+	c.set("hot", &entry{msg: 1, ttl: time.Now().Add(time.Minute)})
+
+	// early in the entry lifetime no prefetch
+	for i := 0; i < prefetchMinHits; i++ {
+		c.get("hot")
+	}
+
+	select {
+	case <-prefetched:
+		t.Fatal("unexpected prefetch")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// pretend the entry was stored an hour ago
+	c.Lock()
+	c.m["hot"].Value.(*cacheItem).stored = time.Now().Add(-time.Hour)
+	c.Unlock()
+
+	c.get("hot")
+	c.get("hot")
+
+	select {
+	case key := <-prefetched:
+		if key != "hot" {
+			t.Fatalf("got key = %s, want hot", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("want prefetch")
+	}
+
+	if stats := c.stats(); stats.Prefetches != 1 {
+		t.Fatalf("got prefetches = %d, want 1", stats.Prefetches)
+	}
+}
@@ -481,6 +481,28 @@ func verifyAnswer(msg *dns.Msg, qname string, qtype uint16) (bool, error) {
 			continue
 		}
 
+		// DNAME redirecting a parent of qname
+		// the synthesized CNAME is unsigned RFC6672 5.3.1
+		if t == dns.TypeDNAME && IsSubDomainStrict(owner, qname) {
+			answer = append(answer, rr)
+			continue
+		}
+
+		if t == dns.TypeRRSIG && IsSubDomainStrict(owner, qname) {
+			sig := rr.(*dns.RRSIG)
+			if sig.TypeCovered != dns.TypeDNAME {
+				continue
+			}
+
+			// wildcard owners aren't supported
+			if sig.Labels < uint8(dns.CountLabel(owner)) {
+				return false, errors.New("bad wildcard DNAME")
+			}
+
+			answer = append(answer, rr)
+			continue
+		}
+
 		if t == dns.TypeRRSIG && strings.EqualFold(qname, owner) {
 			sig := rr.(*dns.RRSIG)
 			if sig.TypeCovered != qtype &&
@@ -2,6 +2,7 @@ package dnssec
 
 import (
 	"bufio"
+	"crypto"
 	"errors"
 	"github.com/miekg/dns"
 	"io/ioutil"
@@ -589,3 +590,68 @@ func dsToRR(dsSet []*dns.DS) []dns.RR {
 	}
 	return rrs
 }
+
+func TestVerifyDNAME(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dname := newRR(t, "old.example. 300 IN DNAME new.example.")
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "old.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		KeyTag:     key.KeyTag(),
+		SignerName: "example.",
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(priv.(crypto.Signer), []dns.RR{dname}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.old.example.", dns.TypeA)
+	msg.Answer = []dns.RR{
+		dname,
+		sig,
+		newRR(t, "www.old.example. 300 IN CNAME www.new.example."),
+	}
+
+	keys := map[uint16]*dns.DNSKEY{key.KeyTag(): key}
+	secure, err := Verify(msg, "example.", "www.old.example.", dns.TypeA, keys, now, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !secure {
+		t.Fatal("want secure")
+	}
+
+	// the unsigned synthesized cname is removed
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			t.Fatalf("got unsigned cname in answer %v", rr)
+		}
+	}
+
+	if len(msg.Answer) != 2 {
+		t.Fatalf("got answer = %v, want DNAME and RRSIG", msg.Answer)
+	}
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
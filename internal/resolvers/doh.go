@@ -0,0 +1,102 @@
+package resolvers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const dohMediaType = "application/dns-message"
+
+// DoHHandler serves DNS-over-HTTPS requests
+// as specified in RFC 8484
+type DoHHandler struct {
+	query QueryFunc
+}
+
+func NewDoHHandler(query QueryFunc) *DoHHandler {
+	return &DoHHandler{query: query}
+}
+
+func (d *DoHHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var raw []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		param := req.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(rw, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+
+		// base64url without padding but accept
+		// padded values from lenient clients
+		if raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			http.Error(rw, "bad dns query parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != dohMediaType {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if raw, err = ioutil.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize)); err != nil {
+			http.Error(rw, "error reading request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(raw); err != nil {
+		http.Error(rw, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), serverQueryTimeout)
+	defer cancel()
+
+	ctx, info := WithQueryInfo(ctx)
+	m := reply(ctx, d.query, r)
+	out, err := m.Pack()
+	if err != nil {
+		http.Error(rw, "error packing dns message", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohMediaType)
+	if info.Stale() {
+		rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	if len(m.Answer) > 0 {
+		// freshness lifetime must not exceed
+		// the smallest ttl in the answer section
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(m.Answer)))
+	}
+
+	rw.Write(out)
+}
+
+// minTTL returns the smallest TTL in rrs
+// in seconds without any clamping
+func minTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	return ttl
+}
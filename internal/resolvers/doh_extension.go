@@ -0,0 +1,361 @@
+package resolvers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"errors"
+	"fingertip/internal/resolvers/dnssec"
+	"fmt"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	dohTimeout = 4 * time.Second
+	dohPath    = "/dns-query"
+)
+
+// lowercase base32 without padding fits in a label
+var dohEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// DoHExtension resolves zones delegated to NS targets
+// like <base32 host[:port]>._doh. by querying
+// https://host[:port]/dns-query. Answers must validate
+// against the DS records of the zone in the root
+// since the endpoint isn't trusted. The endpoint
+// must answer for the whole zone and can't be on
+// a loopback, private or link-local address.
+type DoHExtension struct {
+	rootAddr string
+	client   *http.Client
+
+	// keys verified against the DS records
+	// by zone and endpoint
+	keys *cache
+
+	// optional validation counts
+	metrics *Metrics
+
+	// needed for tests
+	exchangeRoot    exchangeFunc
+	exchangeRootTCP exchangeFunc
+}
+
+// private networks endpoints published on-chain
+// must not reach in addition to loopback and
+// link-local addresses
+var dohBlockedNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return n
+}
+
+// NewDoHExtension uses the root server at rootAddr
+// for the DS records of delegated zones
+func NewDoHExtension(rootAddr string) *DoHExtension {
+	dialer := &net.Dialer{
+		Timeout: dohTimeout,
+		// checked after resolving the host
+		Control: dohDialControl,
+	}
+
+	d := &DoHExtension{
+		rootAddr: rootAddr,
+		client: &http.Client{
+			Timeout: dohTimeout,
+			// endpoints are dialed directly
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: dohTimeout,
+			},
+			// a redirect could point anywhere
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	d.SetCacheConfig(DefaultCacheConfig)
+	d.exchangeRoot = newExchangeFunc("udp", 2*time.Second, nil)
+	d.exchangeRootTCP = newExchangeFunc("tcp", 2*time.Second, nil)
+
+	return d
+}
+
+// SetCacheConfig replaces the key cache
+// must be called before any queries
+func (d *DoHExtension) SetCacheConfig(c CacheConfig) {
+	d.keys.close()
+	d.keys = newCache(c.DNSKEY)
+}
+
+// Close stops background cache maintenance
+func (d *DoHExtension) Close() {
+	d.keys.close()
+}
+
+// dohDialControl refuses connections to
+// loopback, private and link-local addresses
+func dohDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("bad doh address %s", address)
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("doh address %s not allowed", host)
+	}
+
+	for _, n := range dohBlockedNets {
+		if n.Contains(ip) {
+			return fmt.Errorf("doh address %s not allowed", host)
+		}
+	}
+
+	return nil
+}
+
+// dohEndpoint returns the url encoded in the first label of ns
+func dohEndpoint(ns string) (string, error) {
+	raw, err := dohEncoding.DecodeString(strings.ToUpper(FirstNLabels(ns, 1)))
+	if err != nil {
+		return "", fmt.Errorf("bad doh endpoint %s: %v", ns, err)
+	}
+
+	host := string(raw)
+	u, err := url.Parse("https://" + host + dohPath)
+	if err != nil || host == "" || u.Host != host || u.Path != dohPath {
+		return "", fmt.Errorf("bad doh endpoint %s: invalid host %q", ns, host)
+	}
+
+	return u.String(), nil
+}
+
+func (d *DoHExtension) Name() string {
+	return "_doh"
+}
+
+func (d *DoHExtension) CachePolicy() CachePolicy {
+	return CachePolicy{}
+}
+
+// HealthCheck always succeeds since
+// each zone has its own endpoint
+func (d *DoHExtension) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (d *DoHExtension) Handler(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+	endpoint, err := dohEndpoint(ns.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	zone := dns.CanonicalName(ns.Hdr.Name)
+	qname = dns.CanonicalName(qname)
+	keys, err := d.trustedKeys(ctx, zone, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("dnskey error: %v", err)
+	}
+
+	msg, err := d.exchange(ctx, endpoint, qname, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	secure, err := dnssec.Verify(msg, zone, qname, qtype, keys, time.Now(), dnssec.DefaultMinRSAKeySize)
+	d.metrics.observeDNSSEC(secure, err)
+	traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: qname, qtype: qtype, err: err,
+		Detail: fmt.Sprintf("zone %s secure: %v", zone, secure)})
+	if err == nil && !secure {
+		err = errors.New("answer isn't signed")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dnssec verify error: %v", err)
+	}
+
+	markNegative(ctx, qname, msg)
+	if msg.Rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+
+	var rrs []dns.RR
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return rrs, nil
+}
+
+// trustedKeys returns the zone keys from endpoint
+// verified against the DS records in the root
+func (d *DoHExtension) trustedKeys(ctx context.Context, zone, endpoint string) (map[uint16]*dns.DNSKEY, error) {
+	key := zone + " " + endpoint
+	if e, ok := d.keys.get(key); ok {
+		return e.msg.(map[uint16]*dns.DNSKEY), nil
+	}
+
+	ds, err := d.rootDS(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := d.exchange(ctx, endpoint, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := dnssec.VerifyDNSKeys(zone, msg, ds, time.Now(), dnssec.DefaultMinRSAKeySize)
+	traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: zone, qtype: dns.TypeDNSKEY, err: err,
+		Detail: fmt.Sprintf("%d keys verified against root DS records", len(keys))})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, dnssec.ErrNoDNSKEY
+	}
+
+	d.keys.set(key, &entry{
+		msg: keys,
+		ttl: time.Now().Add(getTTL(msg.Answer)),
+	})
+
+	return keys, nil
+}
+
+// rootDS returns the DS records of zone published on-chain
+// unsigned zones are rejected as there's nothing to
+// verify answers from the endpoint against
+func (d *DoHExtension) rootDS(ctx context.Context, zone string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeDS)
+	m.RecursionDesired = false
+	m.SetEdns0(4096, true)
+
+	if err := spendQuery(ctx); err != nil {
+		return nil, err
+	}
+
+	r, rtt, err := exchangeWithFallback(ctx, m, d.rootAddr, d.exchangeRoot, d.exchangeRootTCP)
+	traceExchange(ctx, traceRoot, m, d.rootAddr, r, rtt, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("ds lookup failed with rcode %d", r.Rcode)
+	}
+
+	var ds []dns.RR
+	// in the answer or with a referral
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, zone) {
+			ds = append(ds, rr)
+		}
+	}
+
+	if len(ds) == 0 {
+		return nil, fmt.Errorf("zone %s has no DS records", zone)
+	}
+
+	return ds, nil
+}
+
+// exchange sends a query to endpoint as specified in RFC 8484
+func (d *DoHExtension) exchange(ctx context.Context, endpoint, qname string, qtype uint16) (*dns.Msg, error) {
+	if err := spendQuery(ctx); err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.SetEdns0(4096, true)
+	// answers are validated here
+	m.CheckingDisabled = true
+	// zero id is friendlier to http caches
+	m.Id = 0
+
+	start := time.Now()
+	r, err := d.roundTrip(ctx, endpoint, m)
+	traceExchange(ctx, traceDoH, m, endpoint, r, time.Since(start), err)
+	if err != nil {
+		return nil, fmt.Errorf("doh query to %s failed: %v", endpoint, err)
+	}
+
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("doh query to %s failed: %w (rcode %s)",
+			endpoint, resolver.ErrServFail, dns.RcodeToString[r.Rcode])
+	}
+
+	return r, nil
+}
+
+func (d *DoHExtension) roundTrip(ctx context.Context, endpoint string, m *dns.Msg) (*dns.Msg, error) {
+	raw, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, fmt.Errorf("malformed dns message: %v", err)
+	}
+
+	if len(r.Question) != 1 || !strings.EqualFold(r.Question[0].Name, m.Question[0].Name) ||
+		r.Question[0].Qtype != m.Question[0].Qtype {
+		return nil, errors.New("response question mismatch")
+	}
+
+	return r, nil
+}
@@ -0,0 +1,199 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoHEndpoint(t *testing.T) {
+	ns := strings.ToLower(dohEncoding.EncodeToString([]byte("doh.example:8443"))) + "._doh."
+	endpoint, err := dohEndpoint(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "https://doh.example:8443/dns-query"; endpoint != want {
+		t.Fatalf("got endpoint = %s, want %s", endpoint, want)
+	}
+
+	for _, host := range []string{"doh.example/path", "user@doh.example", "doh.example?q"} {
+		ns := strings.ToLower(dohEncoding.EncodeToString([]byte(host))) + "._doh."
+		if _, err := dohEndpoint(ns); err == nil {
+			t.Fatalf("%s: want error", host)
+		}
+	}
+
+	if _, err := dohEndpoint("not-base32!._doh."); err == nil {
+		t.Fatal("want error for bad encoding")
+	}
+}
+
+func TestDoHDialControl(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:443", "[::1]:443", "10.1.2.3:443", "172.16.0.1:443",
+		"192.168.1.1:443", "100.64.0.1:443", "169.254.169.254:80", "[fe80::1]:443", "[fd00::1]:443", "0.0.0.0:443"} {
+		if err := dohDialControl("tcp", addr, nil); err == nil {
+			t.Fatalf("%s: want error", addr)
+		}
+	}
+
+	for _, addr := range []string{"192.0.2.1:443", "[2001:db8::1]:8443"} {
+		if err := dohDialControl("tcp", addr, nil); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+	}
+}
+
+func TestDoHClient(t *testing.T) {
+	var followed int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == dohPath {
+			http.Redirect(rw, req, "/other", http.StatusFound)
+			return
+		}
+		atomic.AddInt32(&followed, 1)
+	}))
+	defer srv.Close()
+
+	d := NewDoHExtension("0.0.0.0")
+	defer d.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.test.", dns.TypeA)
+	if _, err := d.roundTrip(context.Background(), srv.URL+dohPath, m); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("got err = %v, want loopback refused", err)
+	}
+
+	// allow loopback to check redirects
+	d.client.Transport = http.DefaultTransport
+	if _, err := d.roundTrip(context.Background(), srv.URL+dohPath, m); err == nil {
+		t.Fatal("want error for redirect")
+	}
+
+	if atomic.LoadInt32(&followed) != 0 {
+		t.Fatal("want redirect not followed")
+	}
+}
+
+func TestHIP5DoH(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "test.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string]dns.RR{
+		"www.test.":   testRR("www.test. 300 IN A 10.1.0.1"),
+		"alias.test.": testRR("alias.test. 300 IN CNAME www.test."),
+	}
+	forged := false
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != dohPath {
+			t.Errorf("unexpected request %s %s", req.Method, req.URL)
+		}
+
+		raw, _ := ioutil.ReadAll(req.Body)
+		m := new(dns.Msg)
+		if err := m.Unpack(raw); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !m.CheckingDisabled {
+			t.Error("want checking disabled when validating")
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.SetEdns0(4096, true)
+		q := m.Question[0]
+		switch rr, ok := records[q.Name]; {
+		case q.Qtype == dns.TypeDNSKEY:
+			r.Answer = []dns.RR{key, testSign(t, key, priv, []dns.RR{key})}
+		case ok:
+			r.Answer = []dns.RR{rr, testSign(t, key, priv, []dns.RR{rr})}
+			if forged {
+				r.Answer[0] = testRR(q.Name + " 300 IN A 10.6.6.6")
+			}
+		default:
+			t.Errorf("unexpected query for %s", q.Name)
+		}
+
+		out, _ := r.Pack()
+		rw.Header().Set("Content-Type", dohMediaType)
+		rw.Write(out)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	ns := strings.ToLower(dohEncoding.EncodeToString([]byte(u.Host))) + "._doh."
+	root := func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		switch m.Question[0].Qtype {
+		case dns.TypeNS:
+			r.Ns = []dns.RR{testRR(m.Question[0].Name + " 300 IN NS " + ns)}
+		case dns.TypeDS:
+			if m.Question[0].Name == "test." {
+				r.Answer = []dns.RR{key.ToDS(dns.SHA256)}
+			}
+		}
+		return r, time.Millisecond, nil
+	}
+
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = root
+
+	d := NewDoHExtension("0.0.0.0")
+	defer d.Close()
+	d.exchangeRoot = root
+	d.client = srv.Client()
+	h.RegisterExtension(d)
+
+	res := h.query(context.Background(), "www.test.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if !res.Secure || len(res.Records) != 1 || res.Records[0].String() != records["www.test."].String() {
+		t.Fatalf("got records = %v secure = %v, want secure answer", res.Records, res.Secure)
+	}
+
+	res = h.query(context.Background(), "alias.test.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if !res.Secure || len(res.Records) != 2 {
+		t.Fatalf("got records = %v secure = %v, want secure cname chain", res.Records, res.Secure)
+	}
+
+	// zones without DS records aren't trusted
+	if res := h.query(context.Background(), "www.unsigned.", dns.TypeA); res.Err == nil {
+		t.Fatalf("got records = %v, want error without DS", res.Records)
+	}
+
+	forged = true
+	if res := h.query(context.Background(), "www.test.", dns.TypeA); res.Err == nil {
+		t.Fatalf("got records = %v, want validation error", res.Records)
+	}
+}
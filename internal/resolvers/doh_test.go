@@ -0,0 +1,69 @@
+package resolvers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDoHHandler(t *testing.T) {
+	h := NewDoHHandler(func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+		return &resolver.DNSResult{
+			Records: []dns.RR{
+				testRR("example. 300 IN A 127.0.0.1"),
+				testRR("example. 120 IN A 127.0.0.2"),
+			},
+			Secure: true,
+		}
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	q.Id = 0
+	raw, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(raw), nil)
+	post := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(raw))
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range []*http.Request{get, post} {
+		t.Run(req.Method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/dns-message" {
+				t.Fatalf("got content type = %s", ct)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "max-age=120" {
+				t.Fatalf("got cache control = %s, want max-age=120", cc)
+			}
+
+			m := new(dns.Msg)
+			if err := m.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if !m.AuthenticatedData || len(m.Answer) != 2 {
+				t.Fatalf("got ad = %v, answers = %d", m.AuthenticatedData, len(m.Answer))
+			}
+		})
+	}
+
+	badType := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(raw))
+	badType.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, badType)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("got status = %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+}
@@ -2,11 +2,15 @@ package resolvers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/miekg/dns"
+	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,11 +33,25 @@ type Ethereum struct {
 	rCache *cache
 	// query cache
 	qCache map[uint16]*cache
+
+	// serve-stale window zero if disabled
+	maxStale   time.Duration
+	refreshing sync.Map
+
+	// optional file caches are saved to on close
+	cachePath string
+
+	// optional rpc error counts
+	metrics *Metrics
 }
 
 type queryCacheData struct {
 	registry string
 	rrs      []dns.RR
+
+	// needed to prefetch the record
+	resolver *ensResolver
+	node     [32]byte
 }
 
 func NewEthereum(rawurl string) (*Ethereum, error) {
@@ -44,27 +62,110 @@ func NewEthereum(rawurl string) (*Ethereum, error) {
 
 	e := &Ethereum{
 		client: conn,
-		rCache: newCache(200),
-		qCache: make(map[uint16]*cache),
 	}
 
+	e.SetCacheConfig(DefaultCacheConfig)
+	return e, nil
+}
+
+// SetCacheConfig replaces the ENS caches
+// must be called before any queries
+func (e *Ethereum) SetCacheConfig(c CacheConfig) {
+	e.closeCaches()
+	e.rCache = newCache(c.ENSResolver)
+
 	// caching lower level lookups only
 	// other types should be cached by users
 	// of this client
-	e.qCache[dns.TypeCNAME] = newCache(200)
-	e.qCache[dns.TypeNS] = newCache(500)
-	e.qCache[dns.TypeDS] = newCache(500)
-	return e, nil
+	e.qCache = map[uint16]*cache{
+		dns.TypeCNAME: newCache(c.ENSQuery),
+		dns.TypeNS:    newCache(c.ENSQuery),
+		dns.TypeDS:    newCache(c.ENSQuery),
+		dns.TypeDNAME: newCache(c.ENSQuery),
+	}
+	e.SetServeStale(e.maxStale)
+
+	// refresh popular names before they expire
+	e.rCache.setPrefetch(func(ctx context.Context, key string, _ *entry) {
+		parts := strings.SplitN(key, ";", 2)
+		e.fetchResolverAddress(ctx, parts[0], parts[1])
+	})
+	for qtype, c := range e.qCache {
+		qtype := qtype
+		c.setPrefetch(func(ctx context.Context, qname string, en *entry) {
+			data := en.msg.(*queryCacheData)
+			e.fetchDNSRecord(ctx, data.registry, data.resolver, data.node, qname, qtype)
+		})
+	}
+}
+
+// SetServeStale allows returning expired resolver addresses
+// and delegations up to maxStale if the endpoint fails
+func (e *Ethereum) SetServeStale(maxStale time.Duration) {
+	e.maxStale = maxStale
+	e.rCache.setMaxStale(maxStale)
+	for _, c := range e.qCache {
+		c.setMaxStale(maxStale)
+	}
+}
+
+func (e *Ethereum) CacheStats() map[string]CacheStats {
+	stats := map[string]CacheStats{
+		"ens_resolver": e.rCache.stats(),
+	}
+
+	for qtype, c := range e.qCache {
+		stats[cacheName("ens_query", qtype)] = c.stats()
+	}
+
+	return stats
+}
+
+// Close saves the cache file if set
+// and stops background cache maintenance
+func (e *Ethereum) Close() {
+	if e.cachePath != "" {
+		if err := e.SaveCache(); err != nil {
+			log.Printf("[WARN] ethereum: %v", err)
+		}
+	}
+
+	e.closeCaches()
 }
 
-func (e *Ethereum) GetResolverAddress(node, registryAddress string) (common.Address, error) {
+func (e *Ethereum) closeCaches() {
+	if e.rCache != nil {
+		e.rCache.close()
+	}
+
+	for _, c := range e.qCache {
+		c.close()
+	}
+}
+
+func (e *Ethereum) GetResolverAddress(ctx context.Context, node, registryAddress string) (common.Address, error) {
 	key := node + ";" + registryAddress
-	r, ok := e.rCache.get(key)
-	if ok {
-		if time.Now().Before(r.ttl) {
+	if r, ok := e.rCache.get(key); ok {
+		return r.msg.(common.Address), nil
+	}
+
+	addr, err := e.fetchResolverAddress(ctx, node, registryAddress)
+	if err != nil {
+		if r, ok := e.stale(ctx, e.rCache, key, "resolver;"+key, func(ctx context.Context) {
+			e.GetResolverAddress(ctx, node, registryAddress)
+		}); ok {
 			return r.msg.(common.Address), nil
 		}
-		e.rCache.remove(key)
+
+		return common.Address{}, err
+	}
+
+	return addr, nil
+}
+
+func (e *Ethereum) fetchResolverAddress(ctx context.Context, node, registryAddress string) (common.Address, error) {
+	if err := spendQuery(ctx); err != nil {
+		return common.Address{}, err
 	}
 
 	registry, err := NewENSRegistry(common.HexToAddress(registryAddress), e.client)
@@ -72,11 +173,14 @@ func (e *Ethereum) GetResolverAddress(node, registryAddress string) (common.Addr
 		return common.Address{}, err
 	}
 
-	addr, err := registry.Resolver(nil, EnsNode(node))
+	addr, err := registry.Resolver(&bind.CallOpts{Context: ctx}, EnsNode(node))
 	if err != nil {
+		e.metrics.observeRPCError()
 		return common.Address{}, err
 	}
 
+	key := node + ";" + registryAddress
+
 	e.rCache.set(key, &entry{
 		msg: addr,
 		ttl: time.Now().Add(6 * time.Hour),
@@ -95,12 +199,38 @@ func isZero(addr common.Address) bool {
 	return true
 }
 
-func (e *Ethereum) Resolve(registry string, ra common.Address, qname string, qtype uint16) ([]dns.RR, error) {
+// stale returns expired data from c if serve-stale is enabled
+// and refreshes it in the background
+func (e *Ethereum) stale(ctx context.Context, c *cache, key, refreshKey string, refresh func(ctx context.Context)) (*entry, bool) {
+	if e.maxStale == 0 {
+		return nil, false
+	}
+
+	return serveStale(ctx, c, key, &e.refreshing, refreshKey, refresh)
+}
+
+// ensResolver is a resolver contract
+// binding along with its address
+type ensResolver struct {
+	*DNSResolver
+	addr common.Address
+}
+
+func (e *Ethereum) newResolver(addr common.Address) (*ensResolver, error) {
+	r, err := NewDNSResolver(addr, e.client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ensResolver{DNSResolver: r, addr: addr}, nil
+}
+
+func (e *Ethereum) Resolve(ctx context.Context, registry string, ra common.Address, qname string, qtype uint16) ([]dns.RR, error) {
 	if isZero(ra) {
 		return nil, nil
 	}
 
-	r, err := NewDNSResolver(ra, e.client)
+	r, err := e.newResolver(ra)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +242,7 @@ func (e *Ethereum) Resolve(registry string, ra common.Address, qname string, qty
 		return nil, err
 	}
 
-	res, err := e.queryWithResolver(registry, r, nodeHash, qname, qtype)
+	res, err := e.queryWithResolver(ctx, registry, r, nodeHash, qname, qtype)
 	if err != nil {
 		return nil, err
 	}
@@ -130,42 +260,79 @@ func (e *Ethereum) checkQueryCache(registry string, qname string, qtype uint16)
 		return nil, false
 	}
 
-	if time.Now().After(entry.ttl) {
+	m := entry.msg.(*queryCacheData)
+	if !strings.EqualFold(m.registry, registry) {
 		c.remove(qname)
 		return nil, false
 	}
 
+	return m.rrs, true
+}
+
+func (e *Ethereum) checkStaleQueryCache(ctx context.Context, registry string, r *ensResolver, node [32]byte, qname string, qtype uint16) ([]dns.RR, bool) {
+	c, ok := e.qCache[qtype]
+	if !ok {
+		return nil, false
+	}
+
+	refreshKey := fmt.Sprintf("query;%s;%d;%s", qname, qtype, registry)
+	entry, ok := e.stale(ctx, c, qname, refreshKey, func(ctx context.Context) {
+		e.fetchDNSRecord(ctx, registry, r, node, qname, qtype)
+	})
+	if !ok {
+		return nil, false
+	}
+
 	m := entry.msg.(*queryCacheData)
 	if !strings.EqualFold(m.registry, registry) {
-		c.remove(qname)
 		return nil, false
 	}
 
 	return m.rrs, true
 }
 
-func (e *Ethereum) dnsRecord(registry string, r *DNSResolver, node [32]byte, qname string, qtype uint16) ([]dns.RR, error) {
+func (e *Ethereum) dnsRecord(ctx context.Context, registry string, r *ensResolver, node [32]byte, qname string, qtype uint16) ([]dns.RR, error) {
 	if rrs, ok := e.checkQueryCache(registry, qname, qtype); ok {
 		return rrs, nil
 	}
 
+	rrs, err := e.fetchDNSRecord(ctx, registry, r, node, qname, qtype)
+	if err != nil {
+		if rrs, ok := e.checkStaleQueryCache(ctx, registry, r, node, qname, qtype); ok {
+			return rrs, nil
+		}
+
+		return nil, err
+	}
+
+	return rrs, nil
+}
+
+func (e *Ethereum) fetchDNSRecord(ctx context.Context, registry string, r *ensResolver, node [32]byte, qname string, qtype uint16) ([]dns.RR, error) {
 	qnameHash, err := hashDnsName(qname)
 	if err != nil {
 		return nil, err
 	}
 
-	raw, err := r.DnsRecord(nil, node, qnameHash, qtype)
+	if err := spendQuery(ctx); err != nil {
+		return nil, err
+	}
+
+	raw, err := r.DnsRecord(&bind.CallOpts{Context: ctx}, node, qnameHash, qtype)
 	if err != nil {
+		e.metrics.observeRPCError()
 		return nil, err
 	}
 
 	rrs := unpackRRSet(raw)
 
-	if qtype == dns.TypeCNAME || qtype == dns.TypeNS || qtype == dns.TypeDS {
-		e.qCache[qtype].set(qname, &entry{
+	if c, ok := e.qCache[qtype]; ok {
+		c.set(qname, &entry{
 			msg: &queryCacheData{
 				registry: registry,
 				rrs:      rrs,
+				resolver: r,
+				node:     node,
 			},
 			ttl: time.Now().Add(getTTL(rrs)),
 		})
@@ -174,8 +341,8 @@ func (e *Ethereum) dnsRecord(registry string, r *DNSResolver, node [32]byte, qna
 	return rrs, nil
 }
 
-func (e *Ethereum) queryWithResolver(registry string, r *DNSResolver, nodeHash [32]byte, qname string, qtype uint16) ([]dns.RR, error) {
-	rawRecords, err := e.dnsRecord(registry, r, nodeHash, qname, qtype)
+func (e *Ethereum) queryWithResolver(ctx context.Context, registry string, r *ensResolver, nodeHash [32]byte, qname string, qtype uint16) ([]dns.RR, error) {
+	rawRecords, err := e.dnsRecord(ctx, registry, r, nodeHash, qname, qtype)
 	if err != nil {
 		return nil, err
 	}
@@ -196,14 +363,14 @@ func (e *Ethereum) queryWithResolver(registry string, r *DNSResolver, nodeHash [
 			name := dns.Fqdn(LastNLabels(qname, labels))
 			labels++
 
-			if rawRecords, err = e.dnsRecord(registry, r, nodeHash, name, dns.TypeNS); err != nil {
+			if rawRecords, err = e.dnsRecord(ctx, registry, r, nodeHash, name, dns.TypeNS); err != nil {
 				return nil, err
 			}
 
 			// a delegation exists check if it's signed
 			if len(rawRecords) > 0 {
 				var dsSet []dns.RR
-				if dsSet, err = e.dnsRecord(registry, r, nodeHash, name, dns.TypeDS); err != nil {
+				if dsSet, err = e.dnsRecord(ctx, registry, r, nodeHash, name, dns.TypeDS); err != nil {
 					return nil, err
 				}
 
@@ -219,14 +386,51 @@ func (e *Ethereum) queryWithResolver(registry string, r *DNSResolver, nodeHash [
 	if len(rawRecords) == 0 {
 		// no records for original qname and no delegations
 		// check if a CNAME exists
-		if rawRecords, err = e.dnsRecord(registry, r, nodeHash, qname, dns.TypeCNAME); err != nil {
+		if rawRecords, err = e.dnsRecord(ctx, registry, r, nodeHash, qname, dns.TypeCNAME); err != nil {
 			return nil, err
 		}
 	}
 
+	if len(rawRecords) == 0 {
+		// check if a parent up to maxLabels
+		// redirects its subtree with a DNAME
+		labels := dns.CountLabel(qname) - 1
+		if labels > maxLabels {
+			labels = maxLabels
+		}
+
+		for ; labels >= 2; labels-- {
+			name := dns.Fqdn(LastNLabels(qname, labels))
+			if rawRecords, err = e.dnsRecord(ctx, registry, r, nodeHash, name, dns.TypeDNAME); err != nil {
+				return nil, err
+			}
+
+			if len(rawRecords) > 0 {
+				break
+			}
+		}
+	}
+
 	return rawRecords, nil
 }
 
+func (e *Ethereum) Name() string {
+	return "_eth"
+}
+
+func (e *Ethereum) CachePolicy() CachePolicy {
+	return CachePolicy{}
+}
+
+// HealthCheck verifies the ethereum endpoint is reachable
+func (e *Ethereum) HealthCheck(ctx context.Context) error {
+	if _, err := e.client.BlockNumber(ctx); err != nil {
+		return fmt.Errorf("ethereum endpoint unreachable: %v", err)
+	}
+
+	return nil
+}
+
 func (e *Ethereum) Handler(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
 	registryAddress := FirstNLabels(ns.Ns, 1)
 	node := toNode(qname)
@@ -234,10 +438,92 @@ func (e *Ethereum) Handler(ctx context.Context, qname string, qtype uint16, ns *
 	var resolverAddr common.Address
 	var err error
 
-	resolverAddr, err = e.GetResolverAddress(node, registryAddress)
+	resolverAddr, err = e.GetResolverAddress(ctx, node, registryAddress)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get resolver address from registry %s: %v", registryAddress, err)
 	}
 
-	return e.Resolve(registryAddress, resolverAddr, qname, qtype)
+	return e.Resolve(ctx, registryAddress, resolverAddr, qname, qtype)
+}
+
+// SetCacheFile restores resolver addresses and
+// delegations from path and saves them back to it on Close.
+// Must be called after SetCacheConfig and SetServeStale.
+func (e *Ethereum) SetCacheFile(path string) error {
+	e.cachePath = path
+
+	f, err := readCacheFile(path)
+	if err != nil {
+		return err
+	}
+
+	loadCache(e.rCache, f.Caches["ens_resolver"], func(p persistedEntry) (interface{}, error) {
+		if !common.IsHexAddress(p.Resolver) {
+			return nil, fmt.Errorf("bad resolver address %s", p.Resolver)
+		}
+
+		return common.HexToAddress(p.Resolver), nil
+	})
+
+	for qtype, c := range e.qCache {
+		loadCache(c, f.Caches[cacheName("ens_query", qtype)], func(p persistedEntry) (interface{}, error) {
+			if !common.IsHexAddress(p.Resolver) {
+				return nil, fmt.Errorf("bad resolver address %s", p.Resolver)
+			}
+
+			node := common.FromHex(p.Node)
+			if len(node) != 32 {
+				return nil, fmt.Errorf("bad node %s", p.Node)
+			}
+
+			rrs, err := decodeRRs(p.Records)
+			if err != nil {
+				return nil, err
+			}
+
+			r, err := e.newResolver(common.HexToAddress(p.Resolver))
+			if err != nil {
+				return nil, err
+			}
+
+			data := &queryCacheData{
+				registry: p.Registry,
+				rrs:      rrs,
+				resolver: r,
+			}
+			copy(data.node[:], node)
+			return data, nil
+		})
+	}
+
+	return nil
+}
+
+// SaveCache writes resolver addresses and
+// delegations to the file set by SetCacheFile
+func (e *Ethereum) SaveCache() error {
+	if e.cachePath == "" {
+		return errors.New("no cache file set")
+	}
+
+	f := newCacheFile()
+	f.Caches["ens_resolver"] = saveCache(e.rCache, func(_ string, en *entry) (persistedEntry, bool) {
+		return persistedEntry{
+			Resolver: en.msg.(common.Address).Hex(),
+		}, true
+	})
+
+	for qtype, c := range e.qCache {
+		f.Caches[cacheName("ens_query", qtype)] = saveCache(c, func(_ string, en *entry) (persistedEntry, bool) {
+			data := en.msg.(*queryCacheData)
+			return persistedEntry{
+				Records:  encodeRRs(data.rrs),
+				Registry: data.registry,
+				Resolver: data.resolver.addr.Hex(),
+				Node:     common.Bytes2Hex(data.node[:]),
+			}, true
+		})
+	}
+
+	return writeCacheFile(e.cachePath, f)
 }
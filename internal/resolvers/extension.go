@@ -0,0 +1,253 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckTimeout  = 5 * time.Second
+	healthCheckInterval = 30 * time.Second
+)
+
+// HIP5Handler resolves qname using a hip-5 NS record
+// e.g. 0x123...._eth. for the _eth extension
+type HIP5Handler func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error)
+
+// Extension implements a hip-5 protocol
+// https://github.com/handshake-org/HIPs/blob/master/HIP-0005.md
+type Extension interface {
+	// Name is the pseudo tld used by NS
+	// records delegating to the extension e.g. _eth
+	Name() string
+	Handler(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error)
+	CachePolicy() CachePolicy
+	// HealthCheck returns an error if the extension
+	// is currently unable to resolve names
+	HealthCheck(ctx context.Context) error
+}
+
+// CachePolicy controls how answers from an extension are cached
+type CachePolicy struct {
+	// caps the TTL of returned records
+	// zero uses the record TTLs as is
+	MaxTTL time.Duration
+}
+
+// apply returns rrs with TTLs capped by the policy
+func (p CachePolicy) apply(rrs []dns.RR) []dns.RR {
+	if p.MaxTTL <= 0 {
+		return rrs
+	}
+
+	maxTTL := uint32(p.MaxTTL / time.Second)
+	for _, rr := range rrs {
+		if rr.Header().Ttl > maxTTL {
+			return withMaxTTL(rrs, maxTTL)
+		}
+	}
+
+	return rrs
+}
+
+func withMaxTTL(rrs []dns.RR, maxTTL uint32) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = rr
+		if rr.Header().Ttl > maxTTL {
+			out[i] = dns.Copy(rr)
+			out[i].Header().Ttl = maxTTL
+		}
+	}
+
+	return out
+}
+
+// handlerExtension adapts a HIP5Handler
+// registered with RegisterHandler
+type handlerExtension struct {
+	name    string
+	handler HIP5Handler
+}
+
+func (e *handlerExtension) Name() string {
+	return e.name
+}
+
+func (e *handlerExtension) Handler(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+	return e.handler(ctx, qname, qtype, ns)
+}
+
+func (e *handlerExtension) CachePolicy() CachePolicy {
+	return CachePolicy{}
+}
+
+func (e *handlerExtension) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+// ExtensionStatus reported for debugging
+type ExtensionStatus struct {
+	Enabled bool   `json:"enabled"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ExtensionRegistry holds the hip-5 extensions
+// a resolver may use. Extensions are enabled
+// when registered unless disabled by name.
+type ExtensionRegistry struct {
+	extensions map[string]Extension
+	disabled   map[string]bool
+
+	// last health check results
+	status    map[string]error
+	checkedAt time.Time
+	checkMu   sync.Mutex
+
+	sync.RWMutex
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		extensions: make(map[string]Extension),
+		disabled:   make(map[string]bool),
+	}
+}
+
+var (
+	globalExtensions   []Extension
+	globalExtensionsMu sync.Mutex
+)
+
+// RegisterExtension makes ext available to all
+// resolvers created afterwards. Intended to be
+// called from the init function of the package
+// implementing the extension.
+func RegisterExtension(ext Extension) {
+	globalExtensionsMu.Lock()
+	defer globalExtensionsMu.Unlock()
+
+	globalExtensions = append(globalExtensions, ext)
+}
+
+func registeredExtensions() []Extension {
+	globalExtensionsMu.Lock()
+	defer globalExtensionsMu.Unlock()
+
+	return append([]Extension(nil), globalExtensions...)
+}
+
+// Register adds ext replacing any extension with the same name
+func (r *ExtensionRegistry) Register(ext Extension) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.extensions[ext.Name()] = ext
+}
+
+// SetEnabled enables or disables the extension with
+// the specified name. Names may be set before the
+// extension is registered.
+func (r *ExtensionRegistry) SetEnabled(name string, enabled bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if enabled {
+		delete(r.disabled, name)
+		return
+	}
+
+	r.disabled[name] = true
+}
+
+// Get returns the extension with the specified name if it's enabled
+func (r *ExtensionRegistry) Get(name string) (Extension, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	ext, ok := r.extensions[name]
+	if !ok || r.disabled[name] {
+		return nil, false
+	}
+
+	return ext, true
+}
+
+// Names returns all registered extension names sorted
+func (r *ExtensionRegistry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	names := make([]string, 0, len(r.extensions))
+	for name := range r.extensions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Status runs health checks for enabled extensions
+// results are reused for healthCheckInterval
+func (r *ExtensionRegistry) Status(ctx context.Context) map[string]ExtensionStatus {
+	r.checkMu.Lock()
+	defer r.checkMu.Unlock()
+
+	if r.status == nil || time.Since(r.checkedAt) > healthCheckInterval {
+		r.status = r.healthCheck(ctx)
+		r.checkedAt = time.Now()
+	}
+
+	statuses := make(map[string]ExtensionStatus)
+	for _, name := range r.Names() {
+		_, enabled := r.Get(name)
+		s := ExtensionStatus{Enabled: enabled}
+
+		if err, ok := r.status[name]; ok {
+			s.Healthy = err == nil
+			if err != nil {
+				s.Error = err.Error()
+			}
+		}
+
+		statuses[name] = s
+	}
+
+	return statuses
+}
+
+func (r *ExtensionRegistry) healthCheck(ctx context.Context) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var exts []Extension
+	for _, name := range r.Names() {
+		if ext, ok := r.Get(name); ok {
+			exts = append(exts, ext)
+		}
+	}
+
+	type checkResult struct {
+		name string
+		err  error
+	}
+
+	results := make(chan checkResult, len(exts))
+	for _, ext := range exts {
+		go func(ext Extension) {
+			results <- checkResult{ext.Name(), ext.HealthCheck(ctx)}
+		}(ext)
+	}
+
+	status := make(map[string]error)
+	for range exts {
+		res := <-results
+		status[res.name] = res.err
+	}
+
+	return status
+}
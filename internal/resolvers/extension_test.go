@@ -0,0 +1,148 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+type testExtension struct {
+	name   string
+	rrs    []dns.RR
+	policy CachePolicy
+	health error
+}
+
+func (e *testExtension) Name() string {
+	return e.name
+}
+
+func (e *testExtension) Handler(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+	return e.rrs, nil
+}
+
+func (e *testExtension) CachePolicy() CachePolicy {
+	return e.policy
+}
+
+func (e *testExtension) HealthCheck(ctx context.Context) error {
+	return e.health
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	r := NewExtensionRegistry()
+	r.SetEnabled("_bar", false)
+	r.Register(&testExtension{name: "_foo"})
+	r.Register(&testExtension{name: "_bar", health: errors.New("down")})
+
+	if _, ok := r.Get("_foo"); !ok {
+		t.Fatal("want _foo enabled")
+	}
+
+	if _, ok := r.Get("_bar"); ok {
+		t.Fatal("want _bar disabled")
+	}
+
+	status := r.Status(context.Background())
+	if s := status["_foo"]; !s.Enabled || !s.Healthy {
+		t.Fatalf("got _foo status = %+v, want enabled and healthy", s)
+	}
+
+	// disabled extensions aren't checked
+	if s := status["_bar"]; s.Enabled || s.Healthy || s.Error != "" {
+		t.Fatalf("got _bar status = %+v, want disabled", s)
+	}
+
+	r.SetEnabled("_bar", true)
+	if _, ok := r.Get("_bar"); !ok {
+		t.Fatal("want _bar enabled")
+	}
+}
+
+func TestHIP5ExtensionCachePolicy(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.", []dns.RR{
+		testRR("forever. 300 IN NS a._off."),
+		testRR("forever. 300 IN NS b._short."),
+	})
+
+	h.RegisterExtension(&testExtension{
+		name: "_off",
+		rrs:  []dns.RR{testRR("forever. 3600 IN A 127.0.0.1")},
+	})
+	h.RegisterExtension(&testExtension{
+		name:   "_short",
+		rrs:    []dns.RR{testRR("forever. 3600 IN A 127.0.0.2")},
+		policy: CachePolicy{MaxTTL: time.Minute},
+	})
+	h.Extensions().SetEnabled("_off", false)
+
+	res := h.query(context.Background(), "forever.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	if len(res.Records) != 1 {
+		t.Fatalf("got %d records, want 1", len(res.Records))
+	}
+
+	a := res.Records[0].(*dns.A)
+	if a.A.String() != "127.0.0.2" {
+		t.Fatalf("got a = %s, want 127.0.0.2 from the enabled extension", a.A)
+	}
+
+	if a.Hdr.Ttl != 60 {
+		t.Fatalf("got ttl = %d, want 60", a.Hdr.Ttl)
+	}
+}
+
+func TestHIP5ExtensionDisabled(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.", []dns.RR{
+		testRR("forever. 300 IN NS a._off."),
+	})
+	h.RegisterExtension(&testExtension{
+		name: "_off",
+		rrs:  []dns.RR{testRR("forever. 3600 IN A 127.0.0.1")},
+	})
+
+	if res := h.query(context.Background(), "forever.", dns.TypeA); res.Err != nil || len(res.Records) != 1 {
+		t.Fatalf("got records = %v err = %v, want 1 record", res.Records, res.Err)
+	}
+
+	h.Extensions().SetEnabled("_off", false)
+
+	// the cached delegation is ignored
+	if rrs, ok := h.checkTLDCache("forever."); ok {
+		t.Fatalf("got tld cache = %v, want miss", rrs)
+	}
+
+	if _, err := h.runHandlers(context.Background(), []*dns.NS{testRR("forever. 300 IN NS a._off.").(*dns.NS)},
+		"forever.", dns.TypeA); err != errHIP5NotSupported {
+		t.Fatalf("got err = %v, want %v", err, errHIP5NotSupported)
+	}
+
+	// falls back to the stub answer
+	if res := h.query(context.Background(), "forever.", dns.TypeA); !errors.Is(res.Err, resolver.ErrServFail) {
+		t.Fatalf("got records = %v err = %v, want %v", res.Records, res.Err, resolver.ErrServFail)
+	}
+}
@@ -0,0 +1,340 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fingertip/internal/resolvers/dnssec"
+	"fmt"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const forwardTimeout = 4 * time.Second
+
+// ForwardRule sends names under Suffix to a DNS server
+// instead of resolving them through hnsd
+type ForwardRule struct {
+	Suffix string
+	// udp, tcp or tcp-tls
+	Net  string
+	Addr string
+
+	// DS records for Suffix answers must
+	// validate against if set
+	TrustAnchor []dns.RR
+}
+
+// TrustAnchors DS records by owner name
+type TrustAnchors map[string][]dns.RR
+
+// ReadTrustAnchors reads DS records from a zone file
+func ReadTrustAnchors(path string) (TrustAnchors, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading trust anchors: %v", err)
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(string(data)), ".", path)
+	anchors := make(TrustAnchors)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if _, isDS := rr.(*dns.DS); !isDS {
+			continue
+		}
+
+		name := dns.CanonicalName(rr.Header().Name)
+		anchors[name] = append(anchors[name], rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed parsing trust anchors: %v", err)
+	}
+
+	return anchors, nil
+}
+
+// ParseForwardRule parses rules such as corp=10.0.0.53,
+// corp=tcp://10.0.0.53:53 or corp=tls://ns.corp:853
+// using trust anchors for the suffix if any
+func ParseForwardRule(rule string, anchors TrustAnchors) (ForwardRule, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return ForwardRule{}, fmt.Errorf("bad forward rule %q: want suffix=server", rule)
+	}
+
+	server := strings.TrimSpace(parts[1])
+	r := ForwardRule{
+		Suffix: dns.CanonicalName(strings.TrimSpace(parts[0])),
+		Net:    "udp",
+	}
+
+	port := "53"
+	switch {
+	case strings.HasPrefix(server, "udp://"):
+		server = strings.TrimPrefix(server, "udp://")
+	case strings.HasPrefix(server, "tcp://"):
+		server, r.Net = strings.TrimPrefix(server, "tcp://"), "tcp"
+	case strings.HasPrefix(server, "tls://"):
+		server, r.Net, port = strings.TrimPrefix(server, "tls://"), "tcp-tls", "853"
+	case strings.Contains(server, "://"):
+		return ForwardRule{}, fmt.Errorf("bad forward rule %q: unsupported protocol", rule)
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	if _, ok := dns.IsDomainName(r.Suffix); !ok || server == "" {
+		return ForwardRule{}, fmt.Errorf("bad forward rule %q", rule)
+	}
+
+	r.Addr = server
+	r.TrustAnchor = anchors[r.Suffix]
+	return r, nil
+}
+
+// forwarder a rule with the state needed to use it
+type forwarder struct {
+	ForwardRule
+	exchange    exchangeFunc
+	exchangeTCP exchangeFunc
+
+	// keys verified against the trust anchor
+	keys    map[uint16]*dns.DNSKEY
+	keysTTL time.Time
+	sync.Mutex
+}
+
+// SetForwardRules routes names matching the longest
+// suffix of rules to their server
+func (h *HIP5Resolver) SetForwardRules(rules []ForwardRule) {
+	var forwarders []*forwarder
+	for _, r := range rules {
+		var tlsConfig *tls.Config
+		if r.Net == "tcp-tls" {
+			host, _, _ := net.SplitHostPort(r.Addr)
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+
+		forwarders = append(forwarders, &forwarder{
+			ForwardRule: r,
+			exchange:    newExchangeFunc(r.Net, forwardTimeout, tlsConfig),
+			// retry truncated responses over tcp
+			exchangeTCP: newExchangeFunc("tcp", forwardTimeout, nil),
+		})
+	}
+
+	sort.SliceStable(forwarders, func(i, j int) bool {
+		return dns.CountLabel(forwarders[i].Suffix) > dns.CountLabel(forwarders[j].Suffix)
+	})
+
+	h.forwarders = forwarders
+}
+
+// matchForward returns the forwarder for name or nil
+func (h *HIP5Resolver) matchForward(name string) *forwarder {
+	for _, f := range h.forwarders {
+		if dns.IsSubDomain(f.Suffix, name) {
+			return f
+		}
+	}
+
+	return nil
+}
+
+func (f *forwarder) exchangeMsg(ctx context.Context, qname string, qtype uint16) (*dns.Msg, error) {
+	if err := spendQuery(ctx); err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.SetEdns0(4096, true)
+	// answers are validated here
+	m.CheckingDisabled = len(f.TrustAnchor) > 0
+
+	r, rtt, err := f.exchange(ctx, m, f.Addr)
+	traceStep(ctx, TraceStep{Kind: traceForward, Name: qname, qtype: qtype, Server: f.Addr, RTT: rtt, err: err,
+		Detail: fmt.Sprintf("forwarding %s over %s", f.Suffix, f.Net)})
+	if err != nil {
+		return nil, fmt.Errorf("forwarding to %s failed: %v", f.Addr, err)
+	}
+
+	if r.Truncated && f.Net == "udp" {
+		if r, _, err = f.exchangeTCP(ctx, m, f.Addr); err != nil {
+			return nil, fmt.Errorf("forwarding to %s failed: %v", f.Addr, err)
+		}
+	}
+
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("forwarding to %s failed: %w (rcode %s)",
+			f.Addr, resolver.ErrServFail, dns.RcodeToString[r.Rcode])
+	}
+
+	return r, nil
+}
+
+// trustedKeys returns the zone keys verified against the trust anchor
+func (f *forwarder) trustedKeys(ctx context.Context) (map[uint16]*dns.DNSKEY, error) {
+	f.Lock()
+	keys, ttl := f.keys, f.keysTTL
+	f.Unlock()
+
+	if keys != nil && time.Now().Before(ttl) {
+		return keys, nil
+	}
+
+	msg, err := f.exchangeMsg(ctx, f.Suffix, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err = dnssec.VerifyDNSKeys(f.Suffix, msg, f.TrustAnchor, time.Now(), dnssec.DefaultMinRSAKeySize)
+	traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: f.Suffix, qtype: dns.TypeDNSKEY, err: err,
+		Detail: fmt.Sprintf("%d keys verified against trust anchor", len(keys))})
+	if err != nil {
+		return nil, err
+	}
+
+	// the zone has a trust anchor
+	// so it must be signed
+	if len(keys) == 0 {
+		return nil, dnssec.ErrNoDNSKEY
+	}
+
+	f.Lock()
+	f.keys, f.keysTTL = keys, time.Now().Add(getTTL(msg.Answer))
+	f.Unlock()
+
+	return keys, nil
+}
+
+// forward resolves name using the server of f
+func (h *HIP5Resolver) forward(ctx context.Context, f *forwarder, name string, qtype uint16, depth int) *resolver.DNSResult {
+	if depth > 10 {
+		return &resolver.DNSResult{Err: fmt.Errorf("forwarding failed: %w", errMaxDepthReached)}
+	}
+
+	var keys map[uint16]*dns.DNSKEY
+	if len(f.TrustAnchor) > 0 {
+		var err error
+		if keys, err = f.trustedKeys(ctx); err != nil {
+			return &resolver.DNSResult{Err: fmt.Errorf("dnskey error: %v", err)}
+		}
+	}
+
+	start := time.Now()
+	msg, err := f.exchangeMsg(ctx, name, qtype)
+	h.metrics.observeQuery(metricPathForward, start, err)
+	if err != nil {
+		return &resolver.DNSResult{Err: err}
+	}
+
+	secure := false
+	if keys != nil {
+		secure, err = dnssec.Verify(msg, f.Suffix, name, qtype, keys, time.Now(), dnssec.DefaultMinRSAKeySize)
+		h.metrics.observeDNSSEC(secure, err)
+		traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: name, qtype: qtype, err: err,
+			Detail: fmt.Sprintf("zone %s secure: %v", f.Suffix, secure)})
+		if err == nil && !secure {
+			err = errors.New("answer isn't signed")
+		}
+		if err != nil {
+			return &resolver.DNSResult{Err: fmt.Errorf("dnssec verify error: %v", err)}
+		}
+	}
+
+	markNegative(ctx, name, msg)
+	if msg.Rcode == dns.RcodeNameError && len(msg.Answer) == 0 {
+		return &resolver.DNSResult{Secure: secure}
+	}
+
+	if qtype == dns.TypeCNAME || qtype == dns.TypeDNAME {
+		return &resolver.DNSResult{Records: filterType(msg.Answer, qtype), Secure: secure}
+	}
+
+	rrs, target, err := h.forwardChain(f, msg.Answer, name, qtype)
+	if err != nil || target == "" {
+		return &resolver.DNSResult{Records: rrs, Secure: secure, Err: err}
+	}
+
+	// the chain ends without an answer
+	res := h.queryInternal(ctx, target, qtype, depth+1)
+	if res.Err != nil {
+		return res
+	}
+
+	return &resolver.DNSResult{Records: append(rrs, res.Records...), Secure: secure && res.Secure}
+}
+
+// forwardChain follows the CNAME and DNAME chain in rrs starting at
+// qname using only records of names forwarded to f. It returns the
+// records found and the name to query next if the chain ends
+// without an answer of qtype.
+func (h *HIP5Resolver) forwardChain(f *forwarder, rrs []dns.RR, qname string, qtype uint16) ([]dns.RR, string, error) {
+	var chain []dns.RR
+	seen := make(map[string]bool)
+	name := dns.CanonicalName(qname)
+
+	for !seen[name] {
+		seen[name] = true
+		if h.matchForward(name) != f {
+			return chain, name, nil
+		}
+
+		var answers []dns.RR
+		var cname *dns.CNAME
+		var dnames []*dns.DNAME
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.DNAME:
+				if h.matchForward(rr.Hdr.Name) == f {
+					dnames = append(dnames, rr)
+				}
+			case *dns.CNAME:
+				if strings.EqualFold(rr.Hdr.Name, name) {
+					cname = rr
+				}
+			}
+
+			if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+				answers = append(answers, rr)
+			}
+		}
+
+		if len(answers) > 0 {
+			return append(chain, answers...), "", nil
+		}
+
+		// a DNAME takes precedence over any CNAME
+		// synthesized by the server since the
+		// latter is unsigned
+		synth, dname, err := synthesizeCNAME(dnames, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if synth != nil {
+			chain = append(chain, dname, synth)
+			name = dns.CanonicalName(synth.Target)
+			continue
+		}
+
+		if cname == nil {
+			// nodata
+			if len(chain) == 0 {
+				return nil, "", nil
+			}
+			return chain, name, nil
+		}
+
+		chain = append(chain, cname)
+		name = dns.CanonicalName(cname.Target)
+	}
+
+	return nil, "", errBadCNAMETarget
+}
@@ -0,0 +1,326 @@
+package resolvers
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	anchors := TrustAnchors{
+		"corp.": {testRR("corp. 300 IN DS 1 13 2 0102")},
+	}
+
+	tests := []struct {
+		rule    string
+		want    ForwardRule
+		anchors int
+	}{
+		{"corp=10.0.0.53", ForwardRule{Suffix: "corp.", Net: "udp", Addr: "10.0.0.53:53"}, 1},
+		{"Lab.=tcp://10.0.0.53:5353", ForwardRule{Suffix: "lab.", Net: "tcp", Addr: "10.0.0.53:5353"}, 0},
+		{"lab=tls://ns.lab.example", ForwardRule{Suffix: "lab.", Net: "tcp-tls", Addr: "ns.lab.example:853"}, 0},
+		{"lab=udp://[::1]", ForwardRule{Suffix: "lab.", Net: "udp", Addr: "[::1]:53"}, 0},
+	}
+
+	for _, test := range tests {
+		got, err := ParseForwardRule(test.rule, anchors)
+		if err != nil {
+			t.Fatalf("%s: %v", test.rule, err)
+		}
+
+		if got.Suffix != test.want.Suffix || got.Net != test.want.Net || got.Addr != test.want.Addr {
+			t.Fatalf("%s: got rule = %+v, want %+v", test.rule, got, test.want)
+		}
+
+		if len(got.TrustAnchor) != test.anchors {
+			t.Fatalf("%s: got %d trust anchors, want %d", test.rule, len(got.TrustAnchor), test.anchors)
+		}
+	}
+
+	for _, bad := range []string{"corp", "=10.0.0.53", "corp=https://10.0.0.53"} {
+		if _, err := ParseForwardRule(bad, nil); err == nil {
+			t.Fatalf("%s: want error", bad)
+		}
+	}
+}
+
+func newForwardTestResolver(t *testing.T) *HIP5Resolver {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			t.Fatalf("unexpected stub query for %s", name)
+			return nil
+		},
+	}}
+
+	// forwarded names work while syncing
+	return NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return false
+	})
+}
+
+func TestHIP5Forward(t *testing.T) {
+	h := newForwardTestResolver(t)
+	h.SetForwardRules([]ForwardRule{
+		{Suffix: "corp.", Net: "udp", Addr: "10.0.0.1:53"},
+		{Suffix: "dev.corp.", Net: "udp", Addr: "10.0.0.2:53"},
+	})
+
+	servers := map[string]string{}
+	for _, f := range h.forwarders {
+		f.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+			servers[m.Question[0].Name] = a
+			r := new(dns.Msg)
+			r.SetReply(m)
+			switch m.Question[0].Name {
+			case "www.corp.":
+				r.Answer = []dns.RR{testRR("www.corp. 300 IN CNAME app.dev.corp.")}
+			case "app.dev.corp.":
+				r.Answer = []dns.RR{testRR("app.dev.corp. 300 IN A 10.1.0.1")}
+			default:
+				r.Rcode = dns.RcodeNameError
+			}
+			return r, time.Millisecond, nil
+		}
+	}
+
+	res := h.query(context.Background(), "www.corp.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	want := []string{"www.corp.\t300\tIN\tCNAME\tapp.dev.corp.", "app.dev.corp.\t300\tIN\tA\t10.1.0.1"}
+	if len(res.Records) != len(want) {
+		t.Fatalf("got records = %v, want %v", res.Records, want)
+	}
+	for i, rr := range res.Records {
+		if rr.String() != want[i] {
+			t.Fatalf("got record = %s, want %s", rr, want[i])
+		}
+	}
+
+	if res.Secure {
+		t.Fatal("want insecure answer without a trust anchor")
+	}
+
+	// longest suffix wins
+	if servers["www.corp."] != "10.0.0.1:53" || servers["app.dev.corp."] != "10.0.0.2:53" {
+		t.Fatalf("got servers = %v", servers)
+	}
+
+	ctx, info := WithQueryInfo(context.Background())
+	if res := h.query(ctx, "nx.corp.", dns.TypeA); res.Err != nil || len(res.Records) > 0 {
+		t.Fatalf("got records = %v, err = %v, want none", res.Records, res.Err)
+	}
+	if !info.NXDomain("nx.corp.") {
+		t.Fatal("want nxdomain")
+	}
+}
+
+func TestHIP5ForwardChain(t *testing.T) {
+	h := newForwardTestResolver(t)
+	h.SetForwardRules([]ForwardRule{
+		{Suffix: "corp.", Net: "udp", Addr: "10.0.0.1:53"},
+		{Suffix: "dev.corp.", Net: "udp", Addr: "10.0.0.2:53"},
+	})
+
+	var queried []string
+	for _, f := range h.forwarders {
+		f.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+			queried = append(queried, m.Question[0].Name)
+			r := new(dns.Msg)
+			r.SetReply(m)
+			switch m.Question[0].Name {
+			case "www.corp.":
+				r.Answer = []dns.RR{
+					testRR("www.corp. 300 IN CNAME web.corp."),
+					testRR("web.corp. 300 IN A 10.1.0.1"),
+					// not part of the chain
+					testRR("mail.corp. 300 IN CNAME evil.example."),
+				}
+			case "app.corp.":
+				r.Answer = []dns.RR{
+					testRR("app.corp. 300 IN CNAME app.dev.corp."),
+					// forwarded elsewhere
+					testRR("app.dev.corp. 300 IN A 10.6.6.6"),
+				}
+			case "app.dev.corp.":
+				r.Answer = []dns.RR{testRR("app.dev.corp. 300 IN A 10.1.0.2")}
+			default:
+				r.Rcode = dns.RcodeNameError
+			}
+			return r, time.Millisecond, nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		records []string
+		queried []string
+	}{
+		{
+			name:    "www.corp.",
+			records: []string{"www.corp.\t300\tIN\tCNAME\tweb.corp.", "web.corp.\t300\tIN\tA\t10.1.0.1"},
+			queried: []string{"www.corp."},
+		},
+		{
+			name:    "app.corp.",
+			records: []string{"app.corp.\t300\tIN\tCNAME\tapp.dev.corp.", "app.dev.corp.\t300\tIN\tA\t10.1.0.2"},
+			queried: []string{"app.corp.", "app.dev.corp."},
+		},
+	}
+
+	for _, test := range tests {
+		queried = nil
+		res := h.query(context.Background(), test.name, dns.TypeA)
+		if res.Err != nil {
+			t.Fatalf("%s: %v", test.name, res.Err)
+		}
+
+		if len(res.Records) != len(test.records) {
+			t.Fatalf("%s: got records = %v, want %v", test.name, res.Records, test.records)
+		}
+		for i, rr := range res.Records {
+			if rr.String() != test.records[i] {
+				t.Fatalf("%s: got record = %s, want %s", test.name, rr, test.records[i])
+			}
+		}
+
+		if len(queried) != len(test.queried) {
+			t.Fatalf("%s: got queried = %v, want %v", test.name, queried, test.queried)
+		}
+		for i := range queried {
+			if queried[i] != test.queried[i] {
+				t.Fatalf("%s: got queried = %v, want %v", test.name, queried, test.queried)
+			}
+		}
+	}
+}
+
+func TestHIP5ForwardServeStale(t *testing.T) {
+	h := newForwardTestResolver(t)
+	h.SetServeStale(time.Hour)
+	h.SetForwardRules([]ForwardRule{{Suffix: "corp.", Net: "udp", Addr: "10.0.0.1:53"}})
+
+	var failing int32
+	h.forwarders[0].exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, 0, errors.New("i/o timeout")
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		if m.Question[0].Name == "www.corp." {
+			r.Answer = []dns.RR{testRR("www.corp. 300 IN A 10.1.0.1")}
+		} else {
+			r.Rcode = dns.RcodeNameError
+		}
+		return r, time.Millisecond, nil
+	}
+
+	if res := h.query(context.Background(), "www.corp.", dns.TypeA); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// expire the stored answer
+	key := answerKey("www.corp.", dns.TypeA)
+	e, ok := h.answerCache.getStale(key)
+	if !ok {
+		t.Fatal("want forwarded answer stored")
+	}
+	h.answerCache.set(key, &entry{msg: e.msg, ttl: time.Now().Add(-time.Minute)})
+
+	atomic.StoreInt32(&failing, 1)
+	res := h.query(context.Background(), "www.corp.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatalf("got err = %v, want stale answer", res.Err)
+	}
+
+	if len(res.Records) != 1 || res.Records[0].Header().Ttl != staleTTL {
+		t.Fatalf("got records = %v, want one record with ttl %d", res.Records, staleTTL)
+	}
+
+	// nothing to serve for other names
+	if res := h.query(context.Background(), "other.corp.", dns.TypeA); res.Err == nil {
+		t.Fatalf("got records = %v, want error", res.Records)
+	}
+}
+
+func testSign(t *testing.T, key *dns.DNSKEY, priv crypto.PrivateKey, rrs []dns.RR) dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+
+	if err := sig.Sign(priv.(crypto.Signer), rrs); err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+func TestHIP5ForwardDNSSEC(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "corp.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := testRR("www.corp. 300 IN A 10.1.0.1")
+	forged := false
+
+	h := newForwardTestResolver(t)
+	h.SetForwardRules([]ForwardRule{{
+		Suffix:      "corp.",
+		Net:         "udp",
+		Addr:        "10.0.0.1:53",
+		TrustAnchor: []dns.RR{key.ToDS(dns.SHA256)},
+	}})
+	h.forwarders[0].exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		if !m.CheckingDisabled {
+			t.Fatal("want checking disabled when validating")
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.SetEdns0(4096, true)
+
+		switch m.Question[0].Qtype {
+		case dns.TypeDNSKEY:
+			r.Answer = []dns.RR{key, testSign(t, key, priv, []dns.RR{key})}
+		case dns.TypeA:
+			r.Answer = []dns.RR{answer, testSign(t, key, priv, []dns.RR{answer})}
+			if forged {
+				r.Answer[0] = testRR("www.corp. 300 IN A 10.6.6.6")
+			}
+		}
+		return r, time.Millisecond, nil
+	}
+
+	res := h.query(context.Background(), "www.corp.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	if !res.Secure || len(res.Records) != 1 || res.Records[0].String() != answer.String() {
+		t.Fatalf("got records = %v secure = %v, want secure answer", res.Records, res.Secure)
+	}
+
+	forged = true
+	if res := h.query(context.Background(), "www.corp.", dns.TypeA); res.Err == nil {
+		t.Fatalf("got records = %v, want validation error", res.Records)
+	}
+}
@@ -2,87 +2,216 @@ package resolvers
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fingertip/internal/resolvers/dnssec"
+	"fingertip/internal/resolvers/internal/nsport"
 	"fmt"
 	"github.com/buffrr/letsdane/resolver"
 	"github.com/miekg/dns"
+	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
 var errNotSynced = fmt.Errorf("error: handshake resolver not fully synced")
 var errHIP5NotSupported = errors.New("no supported hip-5 record found")
 var errBadCNAMETarget = errors.New("bad cname target")
+var errBadDNAMETarget = errors.New("bad dname target")
 var errMaxDepthReached = errors.New("max depth reached")
 
-type hip5Handler func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error)
+type exchangeFunc func(ctx context.Context, m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error)
 type QueryMiddlewareFunc func(qname string, qtype uint16) (bool, *resolver.DNSResult)
 
 type HIP5Resolver struct {
-	handlers      map[string]hip5Handler
+	extensions    *ExtensionRegistry
 	onBeforeQuery QueryMiddlewareFunc
+	budget        QueryBudget
 
 	// for sending queries to a trusted root
 	// to get hip-5 addresses
-	rootAddr   string
-	rootClient *dns.Client
-	syncCheck  func() bool
-	tldCache   *cache
-	keyCache   *cache
+	rootAddr    string
+	syncCheck   func() bool
+	syncWait    time.Duration
+	syncWaitMax int32
+	syncWaiting int32
+	tldCache    *cache
+	negTLDCache *cache
+	keyCache    *cache
+
+	// previous answers for serve-stale
+	answerCache *cache
+	maxStale    time.Duration
+	refreshing  sync.Map
+
+	// rcodes and SOAs of negative stub answers
+	stubNegCache *cache
+
+	// optional file caches are saved to on close
+	cachePath string
+
+	// optional user overrides
+	localZone *LocalZone
+	policies  *PolicyZones
+
+	// names sent to other servers by suffix
+	forwarders []*forwarder
+
+	// optional query and dnssec metrics
+	metrics *Metrics
 
 	// stub resolver with no hip-5 support
 	stubQuery func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult
 	*resolver.Stub
 
 	// hip-5 NS recursion
-	nsClient *dns.Client
+	nsStats *serverStats
+	qmin    QNAMEMinimisation
 
 	// needed for tests
-	exchangeRoot func(ctx context.Context, m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error)
-	exchange     func(ctx context.Context, m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error)
+	exchangeRoot    exchangeFunc
+	exchangeRootTCP exchangeFunc
+	exchange        exchangeFunc
+	exchangeTCP     exchangeFunc
+	nsPort          string
+}
+
+func init() {
+	nsport.Set = func(r interface{}, port string) {
+		r.(*HIP5Resolver).nsPort = port
+	}
 }
 
 func NewHIP5Resolver(stub *resolver.Stub, rootAddr string, syncCheck func() bool) *HIP5Resolver {
 	h := &HIP5Resolver{}
 	h.Stub = stub
 	h.syncCheck = syncCheck
-	h.handlers = make(map[string]hip5Handler)
-	h.tldCache = newCache(30)
-	h.keyCache = newCache(200)
+	h.extensions = NewExtensionRegistry()
+	for _, ext := range registeredExtensions() {
+		h.extensions.Register(ext)
+	}
+	h.SetCacheConfig(DefaultCacheConfig)
+	h.budget = DefaultQueryBudget
 
 	// using the same query function used by stub
 	// to benefit from caching
 	h.stubQuery = stub.DefaultResolver.Query
 	h.Stub.DefaultResolver.Query = h.query
+	h.Stub.Verify = h.verifyStub(stub.Verify)
 
 	h.rootAddr = rootAddr
-	h.rootClient = &dns.Client{
-		Net:            "udp",
-		Timeout:        2 * time.Second,
-		SingleInflight: true,
-	}
-	h.exchangeRoot = h.rootClient.ExchangeContext
+	h.exchangeRoot = newExchangeFunc("udp", 2*time.Second, nil)
+	// retry truncated responses over tcp
+	h.exchangeRootTCP = newExchangeFunc("tcp", 2*time.Second, nil)
 
-	h.nsClient = &dns.Client{
-		Net:            "udp",
-		Timeout:        4 * time.Second,
-		SingleInflight: true,
-	}
-	h.exchange = h.nsClient.ExchangeContext
+	h.exchange = newExchangeFunc("udp", 4*time.Second, nil)
+	h.exchangeTCP = newExchangeFunc("tcp", 4*time.Second, nil)
+	h.nsPort = nsport.Default
+	h.nsStats = newServerStats()
+	h.qmin = QNAMEMinimisationRelaxed
 
 	return h
 }
 
-func (h *HIP5Resolver) RegisterHandler(extension string, handler hip5Handler) {
-	h.handlers[extension] = handler
+// RegisterHandler adds an extension using handler
+// with the default cache policy
+func (h *HIP5Resolver) RegisterHandler(extension string, handler HIP5Handler) {
+	h.extensions.Register(&handlerExtension{
+		name:    extension,
+		handler: handler,
+	})
+}
+
+func (h *HIP5Resolver) RegisterExtension(ext Extension) {
+	h.extensions.Register(ext)
+}
+
+func (h *HIP5Resolver) Extensions() *ExtensionRegistry {
+	return h.extensions
 }
 
 func (h *HIP5Resolver) SetQueryMiddleware(m QueryMiddlewareFunc) {
 	h.onBeforeQuery = m
 }
 
+// SetCacheConfig replaces the resolver caches
+// must be called before any queries
+func (h *HIP5Resolver) SetCacheConfig(c CacheConfig) {
+	h.closeCaches()
+	h.tldCache = newCache(c.TLD)
+	h.negTLDCache = newCache(c.NegativeTLD)
+	h.keyCache = newCache(c.DNSKEY)
+	h.answerCache = newCache(c.Answers)
+	h.answerCache.setMaxStale(h.maxStale)
+	h.stubNegCache = newCache(stubNegativeCacheSize)
+
+	// refresh popular delegations before they expire
+	h.tldCache.setPrefetch(func(ctx context.Context, tld string, e *entry) {
+		h.fetchExtensions(ctx, tld)
+	})
+	h.keyCache.setPrefetch(func(ctx context.Context, zone string, e *entry) {
+		data := e.msg.(*dnskeyCacheData)
+		h.fetchDNSKeys(ctx, data.ips, data.ds, zone)
+	})
+}
+
+func (h *HIP5Resolver) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"tld":           h.tldCache.stats(),
+		"negative_tld":  h.negTLDCache.stats(),
+		"dnskey":        h.keyCache.stats(),
+		"answers":       h.answerCache.stats(),
+		"stub_negative": h.stubNegCache.stats(),
+	}
+}
+
+// ClearNegativeCache forgets TLDs previously
+// found to have no hip-5 records. Should be called
+// if the root server restarts.
+func (h *HIP5Resolver) ClearNegativeCache() {
+	h.negTLDCache.clear()
+}
+
+// Close saves the cache file if set
+// and stops background cache maintenance
+func (h *HIP5Resolver) Close() {
+	if h.cachePath != "" {
+		if err := h.SaveCache(); err != nil {
+			log.Printf("[WARN] hip5: %v", err)
+		}
+	}
+
+	h.closeCaches()
+}
+
+func (h *HIP5Resolver) closeCaches() {
+	h.tldCache.close()
+	h.negTLDCache.close()
+	h.keyCache.close()
+	h.answerCache.close()
+	h.stubNegCache.close()
+}
+
+// NeedsSync reports whether looking up name waits for hnsd
+// to sync. Names in the local zone or forwarded elsewhere
+// are answered right away.
+func (h *HIP5Resolver) NeedsSync(name string) bool {
+	if h.localZone != nil {
+		if _, target, ok := h.localZone.lookup(name, dns.TypeA); ok {
+			if target == "" {
+				return false
+			}
+
+			// the chain leaves the zone
+			name = target
+		}
+	}
+
+	return h.matchForward(dns.CanonicalName(name)) == nil
+}
+
 func (h *HIP5Resolver) query(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
 	if h.onBeforeQuery != nil {
 		if ok, res := h.onBeforeQuery(name, qtype); ok {
@@ -90,24 +219,66 @@ func (h *HIP5Resolver) query(ctx context.Context, name string, qtype uint16) *re
 		}
 	}
 
-	return h.queryInternal(ctx, name, qtype, 0)
+	if res := h.queryLocal(ctx, name, qtype); res != nil {
+		return res
+	}
+
+	return h.queryPolicy(ctx, name, qtype, func() *resolver.DNSResult {
+		// park queries while syncing
+		if !h.syncCheck() && h.matchForward(name) == nil {
+			h.waitForSync(ctx)
+		}
+
+		// lookups of nameserver addresses come back
+		// here and share the budget of the outer query
+		budgetCtx, cancel, qb := withBudget(ctx, h.budget)
+		defer cancel()
+
+		res := h.queryInternal(budgetCtx, name, qtype, 0)
+		if qb != nil && res.Err != nil && ctx.Err() == nil &&
+			errors.Is(budgetCtx.Err(), context.DeadlineExceeded) {
+			res = &resolver.DNSResult{
+				Err: fmt.Errorf("%w: took longer than %v", errBudgetExceeded, h.budget.MaxTime),
+			}
+		}
+
+		return res
+	})
 }
 
 func (h *HIP5Resolver) checkTLDCache(tld string) ([]*dns.NS, bool) {
-	e, ok := h.tldCache.get(tld)
-	if !ok {
-		return nil, false
+	if e, ok := h.tldCache.get(tld); ok {
+		// extensions may have been disabled since
+		if ns := h.enabledExtensions(e.msg.([]*dns.NS)); len(ns) > 0 {
+			return ns, true
+		}
 	}
 
-	if time.Now().After(e.ttl) {
-		h.tldCache.remove(tld)
-		return nil, false
+	// known to have no hip-5 records
+	if _, ok := h.negTLDCache.get(tld); ok {
+		return nil, true
 	}
 
-	return e.msg.([]*dns.NS), true
+	return nil, false
 }
 
 func (h *HIP5Resolver) queryInternal(ctx context.Context, name string, qtype uint16, depth int) *resolver.DNSResult {
+	// forwarded names don't need hnsd
+	if f := h.matchForward(dns.CanonicalName(name)); f != nil {
+		name = dns.CanonicalName(name)
+		res := h.forward(ctx, f, name, qtype, depth)
+		if res.Err == nil {
+			h.storeAnswer(name, qtype, res.Records, res.Secure)
+			return res
+		}
+
+		if stale := h.staleAfterError(ctx, name, qtype, res.Err); stale != nil {
+			return stale
+		}
+
+		return res
+	}
+
 	if synced := h.syncCheck(); !synced {
 		return &resolver.DNSResult{
 			Records: nil,
@@ -129,8 +300,23 @@ func (h *HIP5Resolver) queryInternal(ctx context.Context, name string, qtype uin
 	}
 
 	if !known {
+		if err := spendQuery(ctx); err != nil {
+			return &resolver.DNSResult{Err: err}
+		}
+
+		start := time.Now()
 		res = h.stubQuery(ctx, name, qtype)
+		if res.Err == nil {
+			h.markStubNegative(ctx, name, qtype, res.Records)
+		}
+		h.metrics.observeQuery(metricPathStub, start, res.Err)
+		traceStep(ctx, TraceStep{Kind: traceStub, Name: name, qtype: qtype, rrs: res.Records, err: res.Err,
+			Detail: fmt.Sprintf("secure: %v", res.Secure)})
 		if res.Err == nil || !errors.Is(res.Err, resolver.ErrServFail) {
+			// hnsd validates answers itself
+			if res.Err == nil {
+				h.metrics.observeDNSSEC(res.Secure, nil)
+			}
 			return res
 		}
 	}
@@ -139,6 +325,7 @@ func (h *HIP5Resolver) queryInternal(ctx context.Context, name string, qtype uin
 	// or stub couldn't resolve it
 	rrs, secure, errHip5 := h.attemptHIP5Resolution(ctx, tld, name, qtype, depth)
 	if errHip5 == nil {
+		h.storeAnswer(name, qtype, rrs, secure)
 		return &resolver.DNSResult{
 			Records: rrs,
 			Secure:  secure,
@@ -149,9 +336,15 @@ func (h *HIP5Resolver) queryInternal(ctx context.Context, name string, qtype uin
 	// return the original failed response
 	// from the stub unmodified
 	if res != nil && errHip5 == errHIP5NotSupported {
+		// hnsd answers SERVFAIL for bogus data
+		h.metrics.observeDNSSEC(false, res.Err)
 		return res
 	}
 
+	if stale := h.staleAfterError(ctx, name, qtype, errHip5); stale != nil {
+		return stale
+	}
+
 	// name uses a hip5 ns but failed to resolve
 	return &resolver.DNSResult{
 		Records: nil,
@@ -172,6 +365,9 @@ func (h *HIP5Resolver) attemptHIP5Resolution(ctx context.Context, tld, qname str
 
 	if len(hip5Res) > 0 {
 		rrs, err := h.runHandlers(ctx, hip5Res, qname, qtype)
+		if err == errHIP5NotSupported {
+			return nil, false, err
+		}
 		if err != nil {
 			return nil, false, fmt.Errorf("hip-5 resolution failed: %w", err)
 		}
@@ -187,11 +383,14 @@ func (h *HIP5Resolver) attemptHIP5Resolution(ctx context.Context, tld, qname str
 	return nil, false, errHIP5NotSupported
 }
 
+// filterType keeps records of qtype and
+// any CNAME/DNAME chain leading to them
 func filterType(rrs []dns.RR, qtype uint16) []dns.RR {
 	var other []dns.RR
 
 	for _, rr := range rrs {
-		if rr.Header().Rrtype == qtype {
+		switch rr.Header().Rrtype {
+		case qtype, dns.TypeCNAME, dns.TypeDNAME:
 			other = append(other, rr)
 		}
 	}
@@ -205,6 +404,7 @@ func (h *HIP5Resolver) flatten(ctx context.Context, rrs []dns.RR, extra []dns.RR
 	}
 
 	var cnames []*dns.CNAME
+	var dnames []*dns.DNAME
 	var ns []*dns.NS
 	var ds []dns.RR
 
@@ -212,6 +412,8 @@ func (h *HIP5Resolver) flatten(ctx context.Context, rrs []dns.RR, extra []dns.RR
 		switch rr.(type) {
 		case *dns.CNAME:
 			cnames = append(cnames, rr.(*dns.CNAME))
+		case *dns.DNAME:
+			dnames = append(dnames, rr.(*dns.DNAME))
 		case *dns.NS:
 			ns = append(ns, rr.(*dns.NS))
 		case *dns.DS:
@@ -225,8 +427,38 @@ func (h *HIP5Resolver) flatten(ctx context.Context, rrs []dns.RR, extra []dns.RR
 		ds = nil
 	}
 
+	// a DNAME takes precedence over any CNAME
+	// synthesized by the server since the
+	// latter is unsigned
+	cname, dname, err := synthesizeCNAME(dnames, qname)
+	if err != nil {
+		return nil, false, err
+	}
+	if cname != nil {
+		return h.followChain(ctx, []chainLink{{
+			target: cname.Target,
+			rrs:    []dns.RR{dname, cname},
+		}}, secure, qname, qtype, depth)
+	}
+
 	if len(cnames) > 0 {
-		return h.resolveCNAME(ctx, cnames, qname, qtype, depth)
+		links := make([]chainLink, len(cnames))
+		for i, rr := range cnames {
+			links[i] = chainLink{target: rr.Target, rrs: []dns.RR{rr}}
+		}
+
+		return h.followChain(ctx, links, secure, qname, qtype, depth)
+	}
+
+	// AliasMode SVCB/HTTPS are followed like CNAMEs
+	// service mode records are ignored if present
+	if aliases := svcbAlias(rrs, qname, qtype); len(aliases) > 0 {
+		if aliases[0].target == "." {
+			// service isn't available
+			return aliases[0].rrs, secure, nil
+		}
+
+		return h.followChain(ctx, aliases, secure, qname, qtype, depth)
 	}
 
 	if len(ns) > 0 {
@@ -240,21 +472,36 @@ func (h *HIP5Resolver) flatten(ctx context.Context, rrs []dns.RR, extra []dns.RR
 	return rrs, secure, nil
 }
 
-func (h *HIP5Resolver) resolveCNAME(ctx context.Context, rrs []*dns.CNAME, qname string, qtype uint16, depth int) ([]dns.RR, bool, error) {
+// chainLink is a redirect to follow such as a CNAME
+// and the records returned to clients for it
+type chainLink struct {
+	target string
+	rrs    []dns.RR
+}
+
+// followChain resolves the first link that succeeds and returns
+// the link records followed by the target answer. It's only
+// secure if both the link and the target are secure.
+func (h *HIP5Resolver) followChain(ctx context.Context, links []chainLink, secure bool, qname string, qtype uint16, depth int) ([]dns.RR, bool, error) {
 	var lastErr error
-	for _, rr := range rrs {
-		target := dns.CanonicalName(rr.Target)
+	for _, link := range links {
+		target := dns.CanonicalName(link.target)
+		traceStep(ctx, TraceStep{Kind: traceCNAME, Name: qname, qtype: qtype, rrs: link.rrs,
+			Detail: fmt.Sprintf("secure: %v", secure)})
 		if target == qname {
 			return nil, false, errBadCNAMETarget
 		}
 
-		res := h.queryInternal(ctx, rr.Target, qtype, depth+1)
+		res := h.queryInternal(ctx, target, qtype, depth+1)
 		if res.Err != nil {
 			lastErr = res.Err
 			continue
 		}
 
-		return res.Records, res.Secure, nil
+		chain := make([]dns.RR, 0, len(link.rrs)+len(res.Records))
+		chain = append(chain, link.rrs...)
+		chain = append(chain, res.Records...)
+		return chain, secure && res.Secure, nil
 	}
 
 	return nil, false, lastErr
@@ -296,6 +543,19 @@ func (h *HIP5Resolver) lookupNSAddr(ctx context.Context, rr *dns.NS, extra []dns
 		return nil, fmt.Errorf("nil rr")
 	}
 
+	if ips := glueAddrs(rr, extra); len(ips) != 0 {
+		return ips, nil
+	}
+
+	ips, _, err := h.LookupIP(ctx, "ip", rr.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+func glueAddrs(rr *dns.NS, extra []dns.RR) []net.IP {
 	var ips []net.IP
 
 	for _, glue := range extra {
@@ -311,38 +571,78 @@ func (h *HIP5Resolver) lookupNSAddr(ctx context.Context, rr *dns.NS, extra []dns
 		}
 	}
 
+	return ips
+}
+
+// lookupNSAddrs collects the addresses of all nameservers in rrs.
+// Glue is preferred otherwise all names are resolved concurrently.
+func (h *HIP5Resolver) lookupNSAddrs(ctx context.Context, rrs []*dns.NS, extra []dns.RR) ([]net.IP, error) {
+	var ips []net.IP
+	for _, rr := range rrs {
+		for _, ip := range glueAddrs(rr, extra) {
+			ips = appendIP(ips, ip)
+		}
+	}
+
 	if len(ips) != 0 {
 		return ips, nil
 	}
 
-	var err error
-	if ips, _, err = h.LookupIP(ctx, "ip", rr.Ns); err != nil {
-		return nil, err
+	type lookupResult struct {
+		ips []net.IP
+		err error
+	}
+
+	results := make(chan lookupResult, len(rrs))
+	for _, rr := range rrs {
+		go func(rr *dns.NS) {
+			ips, err := h.lookupNSAddr(ctx, rr, nil)
+			results <- lookupResult{ips, err}
+		}(rr)
+	}
+
+	var lastErr error
+	for range rrs {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+
+		for _, ip := range res.ips {
+			ips = appendIP(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no nameserver addresses found")
+		}
+		return nil, lastErr
 	}
 
 	return ips, nil
 }
 
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return ips
+		}
+	}
+
+	return append(ips, ip)
+}
+
 func (h *HIP5Resolver) resolveNS(ctx context.Context, rrs []*dns.NS, ds []dns.RR, extra []dns.RR, qname string, qtype uint16, depth int) ([]dns.RR, bool, error) {
 	delegatedName, err := getDelegatedName(rrs, ds, qname)
 	if err != nil {
 		return nil, false, err
 	}
 
-	var msg *dns.Msg
-	var nsIPs []net.IP
-
-	for _, rr := range rrs {
-		if nsIPs, err = h.lookupNSAddr(ctx, rr, extra); err != nil {
-			continue
-		}
-		if msg, err = h.exchangeNS(ctx, nsIPs, qname, qtype); err == nil {
-			break
-		}
-	}
-
-	if msg == nil {
-		return nil, false, fmt.Errorf("failed to read message")
+	nsIPs, err := h.lookupNSAddrs(ctx, rrs, extra)
+	if err != nil {
+		return nil, false, err
 	}
 
 	var keys map[uint16]*dns.DNSKEY
@@ -353,13 +653,39 @@ func (h *HIP5Resolver) resolveNS(ctx context.Context, rrs []*dns.NS, ds []dns.RR
 		}
 	}
 
+	// msgName may be an ancestor of qname
+	// if a referral was found while minimising
+	start := time.Now()
+	msg, msgName, msgType, err := h.exchangeMinimised(ctx, nsIPs, delegatedName, qname, qtype)
+	h.metrics.observeQuery(metricPathNS, start, err)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read message: %w", err)
+	}
+
 	signed := len(keys) > 0
 	var secure bool
 
 	if signed {
-		if secure, err = dnssec.Verify(msg, delegatedName, qname, qtype, keys, time.Now(), 2048); err != nil {
+		secure, err = dnssec.Verify(msg, delegatedName, msgName, msgType, keys, time.Now(), 2048)
+		h.metrics.observeDNSSEC(secure, err)
+		traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: msgName, qtype: msgType, err: err,
+			Detail: fmt.Sprintf("zone %s secure: %v", delegatedName, secure)})
+		if err != nil {
 			return nil, false, fmt.Errorf("dnssec verify error: %v", err)
 		}
+	} else {
+		h.metrics.observeDNSSEC(false, nil)
+		traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: msgName, qtype: msgType,
+			Detail: fmt.Sprintf("zone %s is unsigned", delegatedName)})
+	}
+
+	// names below a missing name don't exist either
+	if msgName == qname || msg.Rcode == dns.RcodeNameError {
+		markNegative(ctx, qname, msg)
+	}
+
+	if msg.Rcode == dns.RcodeNameError {
+		return nil, secure, nil
 	}
 
 	// limit recursion depth
@@ -374,25 +700,39 @@ func (h *HIP5Resolver) resolveNS(ctx context.Context, rrs []*dns.NS, ds []dns.RR
 
 func (h *HIP5Resolver) queryDNSKeys(ctx context.Context, ips []net.IP, ds []dns.RR, delegatedName string) (map[uint16]*dns.DNSKEY, error) {
 	if entry, ok := h.keyCache.get(delegatedName); ok {
-		if time.Now().Before(entry.ttl) {
-			msg := new(dns.Msg)
-			msg.Rcode = dns.RcodeSuccess
-			msg.Answer = entry.msg.([]dns.RR)
-
-			keys, err := dnssec.VerifyDNSKeys(delegatedName, msg, ds, time.Now(), 2048)
-			if err == nil {
-				return keys, nil
-			}
+		msg := new(dns.Msg)
+		msg.Rcode = dns.RcodeSuccess
+		msg.Answer = entry.msg.(*dnskeyCacheData).rrs
+
+		keys, err := dnssec.VerifyDNSKeys(delegatedName, msg, ds, time.Now(), 2048)
+		traceStep(ctx, TraceStep{Kind: traceCache, Name: delegatedName, qtype: dns.TypeDNSKEY, rrs: msg.Answer, err: err,
+			Detail: "dnskey cache"})
+		if err == nil {
+			return keys, nil
 		}
 		h.keyCache.remove(delegatedName)
 	}
 
+	return h.fetchDNSKeys(ctx, ips, ds, delegatedName)
+}
+
+// dnskeyCacheData keeps what's needed
+// to refresh the key set
+type dnskeyCacheData struct {
+	rrs []dns.RR
+	ips []net.IP
+	ds  []dns.RR
+}
+
+func (h *HIP5Resolver) fetchDNSKeys(ctx context.Context, ips []net.IP, ds []dns.RR, delegatedName string) (map[uint16]*dns.DNSKEY, error) {
 	msg, err := h.exchangeNS(ctx, ips, delegatedName, dns.TypeDNSKEY)
 	if err != nil {
 		return nil, err
 	}
 
 	keys, err := dnssec.VerifyDNSKeys(delegatedName, msg, ds, time.Now(), 2048)
+	traceStep(ctx, TraceStep{Kind: traceDNSSEC, Name: delegatedName, qtype: dns.TypeDNSKEY, err: err,
+		Detail: fmt.Sprintf("%d keys verified against DS", len(keys))})
 	if err != nil {
 		return nil, err
 	}
@@ -401,47 +741,215 @@ func (h *HIP5Resolver) queryDNSKeys(ctx context.Context, ips []net.IP, ds []dns.
 	}
 
 	h.keyCache.set(delegatedName, &entry{
-		msg: msg.Answer,
+		msg: &dnskeyCacheData{
+			rrs: msg.Answer,
+			ips: ips,
+			ds:  ds,
+		},
 		ttl: time.Now().Add(getTTL(msg.Answer)),
 	})
 
 	return keys, nil
 }
 
-func (h *HIP5Resolver) exchangeNS(ctx context.Context, ips []net.IP, qname string, qtype uint16) (res *dns.Msg, err error) {
+func (h *HIP5Resolver) exchangeNS(ctx context.Context, ips []net.IP, qname string, qtype uint16) (*dns.Msg, error) {
 	m := new(dns.Msg)
 	m.SetQuestion(qname, qtype)
 	m.RecursionDesired = false
 	m.CheckingDisabled = true
 	m.SetEdns0(4096, true)
 
-	for _, ip := range ips {
-		if res, _, err = h.exchange(ctx, m, ip.String()+":53"); err != nil {
-			continue
+	if len(ips) == 0 {
+		return nil, errors.New("no nameserver addresses")
+	}
+
+	if err := spendQuery(ctx); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = nsAddr(ip, h.nsPort)
+	}
+
+	return h.raceExchange(ctx, m, h.nsStats.order(addrs))
+}
+
+// raceExchange sends m to addrs in order of preference
+// starting the next server if the current one doesn't
+// answer within its stagger delay or fails (happy eyeballs style).
+// The first usable response wins.
+func (h *HIP5Resolver) raceExchange(ctx context.Context, m *dns.Msg, addrs []string) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type exchangeResult struct {
+		msg *dns.Msg
+		err error
+	}
+
+	results := make(chan exchangeResult, len(addrs))
+	next, inflight := 0, 0
+
+	launch := func() time.Duration {
+		addr := addrs[next]
+		next++
+		inflight++
+
+		go func() {
+			r, rtt, err := h.exchangeHardened(ctx, m, addr)
+			if err == nil && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+				err = fmt.Errorf("server %s returned rcode %s", addr, dns.RcodeToString[r.Rcode])
+			}
+			traceExchange(ctx, traceNS, m, addr, r, rtt, err)
+
+			switch {
+			case err == nil:
+				h.nsStats.success(addr, rtt)
+			case ctx.Err() == nil:
+				// don't penalize servers for
+				// queries we cancelled
+				h.nsStats.failure(addr)
+				h.nsStats.unreachable(addr, err)
+			}
+
+			results <- exchangeResult{r, err}
+		}()
+
+		return h.nsStats.stagger(addr)
+	}
+
+	timer := time.NewTimer(launch())
+	defer timer.Stop()
+
+	var lastErr error
+	for inflight > 0 {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				return res.msg, nil
+			}
+
+			lastErr = res.err
+
+			// failed fast no need to wait
+			if next < len(addrs) {
+				// drop a tick that fired meanwhile so
+				// the next server gets its full stagger
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(launch())
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				timer.Reset(launch())
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+	}
 
-		if res.Truncated {
-			err = errors.New("response truncated")
-			continue
+	return nil, lastErr
+}
+
+// newExchangeFunc returns an exchange using a new client for
+// every query. Client.ExchangeContext ignores cancellation and
+// sets the Dialer of a shared client on each call which races.
+func newExchangeFunc(network string, timeout time.Duration, tlsConfig *tls.Config) exchangeFunc {
+	return func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
 		}
 
-		return
+		c := &dns.Client{
+			Net:       network,
+			Timeout:   timeout,
+			TLSConfig: tlsConfig,
+		}
+
+		conn, err := c.Dial(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer conn.Close()
+
+		// unblock the exchange once ctx is done
+		// which also enforces its deadline
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+
+		r, rtt, err := c.ExchangeWithConn(m, conn)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		return r, rtt, err
+	}
+}
+
+// exchangeWithFallback sends m over udp and retries
+// over tcp if the response is truncated
+func exchangeWithFallback(ctx context.Context, m *dns.Msg, addr string, udp, tcp exchangeFunc) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := udp(ctx, m, addr)
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	if !r.Truncated {
+		return r, rtt, nil
+	}
+
+	if r, rtt, err = tcp(ctx, m, addr); err != nil {
+		return nil, rtt, fmt.Errorf("response truncated and tcp retry failed: %w", err)
 	}
 
-	return
+	if r.Truncated {
+		return nil, rtt, errors.New("response truncated")
+	}
+
+	return r, rtt, nil
+}
+
+// enabledExtensions returns the delegations
+// in ns handled by an enabled extension
+func (h *HIP5Resolver) enabledExtensions(ns []*dns.NS) []*dns.NS {
+	var enabled []*dns.NS
+	for _, rr := range ns {
+		if _, ok := h.extensions.Get(LastNLabels(rr.Ns, 1)); ok {
+			enabled = append(enabled, rr)
+		}
+	}
+
+	return enabled
 }
 
 func (h *HIP5Resolver) runHandlers(ctx context.Context, extensions []*dns.NS, qname string, qtype uint16) ([]dns.RR, error) {
-	var lastErr error
+	lastErr := errHIP5NotSupported
 	var res []dns.RR
 
 	for _, rr := range extensions {
 		tld := LastNLabels(rr.Ns, 1)
-		if handler, ok := h.handlers[tld]; ok {
-			res, lastErr = handler(ctx, qname, qtype, rr)
+		if ext, ok := h.extensions.Get(tld); ok {
+			start := time.Now()
+			res, lastErr = ext.Handler(ctx, qname, qtype, rr)
+			h.metrics.observeQuery(ext.Name(), start, lastErr)
+			traceStep(ctx, TraceStep{Kind: traceExtension, Name: qname, qtype: qtype, rrs: res, err: lastErr,
+				Detail: fmt.Sprintf("%s via %s", ext.Name(), rr.Ns)})
 
 			if lastErr == nil {
-				return res, nil
+				return ext.CachePolicy().apply(res), nil
 			}
 		}
 	}
@@ -455,52 +963,159 @@ func (h *HIP5Resolver) lookupExtensions(ctx context.Context, tld string) ([]*dns
 	}
 
 	if tld == "eth." {
+		traceStep(ctx, TraceStep{Kind: traceCache, Name: tld, qtype: dns.TypeNS, rrs: nsToRR(ethNS),
+			Detail: "built-in .eth delegation"})
 		return ethNS, nil
 	}
 
 	if rrs, ok := h.checkTLDCache(tld); ok {
+		detail := "tld cache"
+		if len(rrs) == 0 {
+			detail = "negative tld cache no hip-5 records"
+		}
+		traceStep(ctx, TraceStep{Kind: traceCache, Name: tld, qtype: dns.TypeNS, rrs: nsToRR(rrs),
+			Detail: detail})
 		return rrs, nil
 	}
 
+	return h.fetchExtensions(ctx, tld)
+}
+
+func (h *HIP5Resolver) fetchExtensions(ctx context.Context, tld string) ([]*dns.NS, error) {
 	m := new(dns.Msg)
 	m.SetQuestion(tld, dns.TypeNS)
 	m.RecursionDesired = false
 	m.SetEdns0(4096, true)
 
-	r, _, err := h.exchangeRoot(ctx, m, h.rootAddr)
-	if err != nil {
+	if err := spendQuery(ctx); err != nil {
 		return nil, err
 	}
 
-	if r.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("hip-5 lookup failed with rcode %d", r.Rcode)
+	r, rtt, err := exchangeWithFallback(ctx, m, h.rootAddr, h.exchangeRoot, h.exchangeRootTCP)
+	traceExchange(ctx, traceRoot, m, h.rootAddr, r, rtt, err)
+	if err != nil {
+		return nil, err
 	}
 
-	if r.Truncated {
-		return nil, errors.New("response truncated")
+	if r.Rcode == dns.RcodeNameError {
+		h.negTLDCache.set(tld, &entry{
+			ttl: time.Now().Add(getNegativeTTL(r)),
+		})
+		return nil, nil
 	}
 
-	var answer []*dns.NS
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("hip-5 lookup failed with rcode %d", r.Rcode)
+	}
 
+	var delegations []*dns.NS
 	for _, rr := range r.Ns {
 		if ns, ok := rr.(*dns.NS); ok {
-			ending := LastNLabels(ns.Ns, 1)
-
-			// include supported HIP-5 extensions only
-			if _, ok := h.handlers[ending]; ok {
-				answer = append(answer, ns)
-			}
+			delegations = append(delegations, ns)
 		}
 	}
 
-	// only cache positive answers
+	// include supported HIP-5 extensions only
+	answer := h.enabledExtensions(delegations)
+
 	if len(answer) > 0 {
 		ttl := getTTL(nsToRR(answer))
 		h.tldCache.set(tld, &entry{
 			msg: answer,
 			ttl: time.Now().Add(ttl),
 		})
+
+		return answer, nil
 	}
 
+	// negative cache to avoid querying the root
+	// for every failed stub lookup
+	h.negTLDCache.set(tld, &entry{
+		ttl: time.Now().Add(getNegativeTTL(r)),
+	})
+
 	return answer, nil
 }
+
+// SetCacheFile restores tld and dnskey caches
+// from path and saves them back to it on Close.
+// Must be called after SetCacheConfig.
+func (h *HIP5Resolver) SetCacheFile(path string) error {
+	h.cachePath = path
+
+	f, err := readCacheFile(path)
+	if err != nil {
+		return err
+	}
+
+	loadCache(h.tldCache, f.Caches["tld"], func(p persistedEntry) (interface{}, error) {
+		rrs, err := decodeRRs(p.Records)
+		if err != nil {
+			return nil, err
+		}
+
+		var ns []*dns.NS
+		for _, rr := range rrs {
+			if n, ok := rr.(*dns.NS); ok {
+				ns = append(ns, n)
+			}
+		}
+		if len(ns) == 0 {
+			return nil, errors.New("no ns records")
+		}
+
+		return ns, nil
+	})
+
+	// keys are verified against the
+	// DS set again before use
+	loadCache(h.keyCache, f.Caches["dnskey"], func(p persistedEntry) (interface{}, error) {
+		var err error
+		data := &dnskeyCacheData{}
+		if data.rrs, err = decodeRRs(p.Records); err != nil {
+			return nil, err
+		}
+		if data.ds, err = decodeRRs(p.DS); err != nil {
+			return nil, err
+		}
+		for _, a := range p.Addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				data.ips = append(data.ips, ip)
+			}
+		}
+
+		return data, nil
+	})
+
+	return nil
+}
+
+// SaveCache writes tld and dnskey
+// caches to the file set by SetCacheFile
+func (h *HIP5Resolver) SaveCache() error {
+	if h.cachePath == "" {
+		return errors.New("no cache file set")
+	}
+
+	f := newCacheFile()
+	f.Caches["tld"] = saveCache(h.tldCache, func(_ string, e *entry) (persistedEntry, bool) {
+		return persistedEntry{
+			Records: encodeRRs(nsToRR(e.msg.([]*dns.NS))),
+		}, true
+	})
+
+	f.Caches["dnskey"] = saveCache(h.keyCache, func(_ string, e *entry) (persistedEntry, bool) {
+		data := e.msg.(*dnskeyCacheData)
+		p := persistedEntry{
+			Records: encodeRRs(data.rrs),
+			DS:      encodeRRs(data.ds),
+		}
+		for _, ip := range data.ips {
+			p.Addrs = append(p.Addrs, ip.String())
+		}
+
+		return p, true
+	})
+
+	return writeCacheFile(h.cachePath, f)
+}
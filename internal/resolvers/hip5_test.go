@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"github.com/buffrr/letsdane/resolver"
 	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -60,9 +63,42 @@ func testRR(str string) dns.RR {
 	return rr
 }
 
-type rootFunc func(ctx context.Context, m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error)
+// testFile writes data to name in a
+// directory removed after the test
+func testFile(t *testing.T, name, data string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// testStubResolver returns a synced resolver whose stub has secure
+// answers for records by owner name and type. Other lookups fail.
+func testStubResolver(records ...string) *HIP5Resolver {
+	var rrs []dns.RR
+	for _, r := range records {
+		rrs = append(rrs, testRR(r))
+	}
 
-func testExchangeRootFunc(t *testing.T, tld string, nsRRs []dns.RR) rootFunc {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			for _, rr := range rrs {
+				if rr.Header().Name == name && rr.Header().Rrtype == qtype {
+					return &resolver.DNSResult{Records: []dns.RR{rr}, Secure: true}
+				}
+			}
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	return NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+}
+
+func testExchangeRootFunc(t *testing.T, tld string, nsRRs []dns.RR) exchangeFunc {
 	return func(ctx context.Context, m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error) {
 		m.Rcode = dns.RcodeSuccess
 		if m.Question[0].Name != tld {
@@ -195,3 +231,257 @@ func TestHIP5CNames(t *testing.T) {
 		})
 	}
 }
+
+func TestHIP5CNameChain(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			if name == "secure.test." {
+				return &resolver.DNSResult{
+					Records: []dns.RR{testRR("secure.test. 300 IN A 127.0.0.1")},
+					Secure:  true,
+				}
+			}
+
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS chain._example.")})
+
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		switch qname {
+		case "a.forever.":
+			return []dns.RR{testRR("a.forever. 300 IN CNAME b.forever.")}, nil
+		case "b.forever.":
+			return []dns.RR{testRR("b.forever. 300 IN CNAME secure.test.")}, nil
+		}
+
+		return nil, nil
+	})
+
+	res := h.query(context.Background(), "a.forever.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	want := []string{"a.forever.", "b.forever.", "secure.test."}
+	if len(res.Records) != len(want) {
+		t.Fatalf("got records = %v, want chain %v", res.Records, want)
+	}
+
+	for i, name := range want {
+		if res.Records[i].Header().Name != name {
+			t.Fatalf("got records[%d] = %v, want owner %s", i, res.Records[i], name)
+		}
+	}
+
+	if !res.Secure {
+		t.Fatal("want secure chain")
+	}
+
+	// an insecure link makes the whole chain insecure
+	link := chainLink{target: "secure.test.", rrs: []dns.RR{testRR("c.forever. 300 IN CNAME secure.test.")}}
+	rrs, secure, err := h.followChain(context.Background(), []chainLink{link}, false, "c.forever.", dns.TypeA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secure {
+		t.Fatal("want insecure chain")
+	}
+
+	if len(rrs) != 2 || rrs[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("got records = %v, want CNAME and A", rrs)
+	}
+}
+
+func TestHIP5TruncatedFallback(t *testing.T) {
+	dummyResolver := resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			if name == "ns.example." {
+				res := &resolver.DNSResult{}
+				if qtype == dns.TypeA {
+					res.Records = []dns.RR{testRR("ns.example. 300 IN A 127.0.0.1")}
+				}
+				return res
+			}
+
+			return &resolver.DNSResult{
+				Records: nil,
+				Secure:  false,
+				Err:     resolver.ErrServFail,
+			}
+		},
+	}
+
+	stub := &resolver.Stub{DefaultResolver: dummyResolver}
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+
+	truncated := func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Truncated = true
+		return r, 0, nil
+	}
+
+	rootTCP := 0
+	h.exchangeRoot = truncated
+	h.exchangeRootTCP = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		rootTCP++
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Ns = []dns.RR{testRR("big. 300 IN NS ns._example.")}
+		return r, 0, nil
+	}
+
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		return []dns.RR{testRR("www.big. 300 IN NS ns.example.")}, nil
+	})
+
+	nsTCP := 0
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		if a != "127.0.0.1:53" {
+			t.Fatalf("got ns addr = %s, want 127.0.0.1:53", a)
+		}
+		return truncated(ctx, m, a)
+	}
+	h.exchangeTCP = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		nsTCP++
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = []dns.RR{testRR("www.big. 300 IN A 127.0.0.2")}
+		return r, 0, nil
+	}
+
+	ips, _, err := h.LookupIP(context.Background(), "ip4", "www.big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("got ips = %v, want [127.0.0.2]", ips)
+	}
+
+	if rootTCP != 1 || nsTCP != 1 {
+		t.Fatalf("got root tcp = %d, ns tcp = %d, want 1 each", rootTCP, nsTCP)
+	}
+
+	// tcp retry is truncated as well
+	h.tldCache = newCache(30)
+	h.exchangeRootTCP = truncated
+	if _, _, err = h.LookupIP(context.Background(), "ip4", "www.big"); err == nil {
+		t.Fatal("want error for truncated tcp response")
+	}
+}
+
+func TestHIP5NegativeCache(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		return nil, errors.New("unexpected hip-5 lookup")
+	})
+
+	rootQueries := 0
+	h.exchangeRoot = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		rootQueries++
+		r := new(dns.Msg)
+		r.SetReply(m)
+		if m.Question[0].Name == "nx." {
+			r.Rcode = dns.RcodeNameError
+			r.Ns = []dns.RR{testRR(". 86400 IN SOA . . 1 1800 900 604800 600")}
+			return r, 0, nil
+		}
+
+		r.Ns = []dns.RR{testRR(m.Question[0].Name + " 21600 IN NS ns1.regular.")}
+		return r, 0, nil
+	}
+
+	for _, name := range []string{"www.regular", "nx"} {
+		for i := 0; i < 3; i++ {
+			if _, _, err := h.LookupIP(context.Background(), "ip4", name); !errors.Is(err, resolver.ErrServFail) {
+				t.Fatalf("got err = %v, want %v", err, resolver.ErrServFail)
+			}
+		}
+	}
+
+	if rootQueries != 2 {
+		t.Fatalf("got root queries = %d, want 2", rootQueries)
+	}
+
+	h.ClearNegativeCache()
+	h.LookupIP(context.Background(), "ip4", "www.regular")
+	if rootQueries != 3 {
+		t.Fatalf("got root queries = %d, want 3 after clearing", rootQueries)
+	}
+}
+
+func TestHIP5DNAME(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS dname._example.")})
+
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		switch {
+		case qname == "www.new.forever.":
+			return []dns.RR{testRR("www.new.forever. 300 IN A 127.0.0.1")}, nil
+		case dns.IsSubDomain("old.forever.", qname):
+			return []dns.RR{testRR("old.forever. 300 IN DNAME new.forever.")}, nil
+		case dns.IsSubDomain("loop.forever.", qname):
+			return []dns.RR{testRR("loop.forever. 300 IN DNAME x.loop.forever.")}, nil
+		}
+
+		return nil, nil
+	})
+
+	res := h.query(context.Background(), "www.old.forever.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// DNAME, synthesized CNAME and the target
+	if len(res.Records) != 3 || res.Records[0].Header().Rrtype != dns.TypeDNAME ||
+		res.Records[1].(*dns.CNAME).Target != "www.new.forever." ||
+		res.Records[2].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("got records = %v, want DNAME chain to 127.0.0.1", res.Records)
+	}
+
+	if !res.Secure {
+		t.Fatal("want secure answer")
+	}
+
+	// querying the DNAME itself
+	res = h.query(context.Background(), "old.forever.", dns.TypeDNAME)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	if len(res.Records) != 1 || res.Records[0].Header().Rrtype != dns.TypeDNAME {
+		t.Fatalf("got records = %v, want DNAME", res.Records)
+	}
+
+	res = h.query(context.Background(), "www.loop.forever.", dns.TypeA)
+	if !errors.Is(res.Err, errMaxDepthReached) {
+		t.Fatalf("got err = %v, want %v", res.Err, errMaxDepthReached)
+	}
+}
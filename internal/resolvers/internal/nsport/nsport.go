@@ -0,0 +1,12 @@
+// Package nsport lets resolverstest send queries for
+// HIP-5 nameservers to its authoritative server which
+// can't listen on port 53 without privileges.
+package nsport
+
+// Default port of HIP-5 nameservers
+const Default = "53"
+
+// Set changes the nameserver port of a resolver.
+// It's assigned by package resolvers since
+// it can't be imported here.
+var Set func(r interface{}, port string)
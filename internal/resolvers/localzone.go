@@ -0,0 +1,244 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the zone file is checked for changes
+	localZoneCheckInterval = time.Second
+	localZoneDefaultTTL    = 60
+	maxLocalCNAMEs         = 10
+)
+
+const localZoneTemplate = `; Local overrides for Handshake names in RFC 1035 zone file format.
+; Names here are answered before any network lookup and are
+; reloaded when this file changes. For example:
+;
+; $TTL 60
+; mysite.        IN A     127.0.0.1
+; www.mysite.    IN CNAME mysite.
+; *.staging.mysite. IN A  10.0.0.2
+`
+
+// LocalZone answers names from a user edited zone file
+type LocalZone struct {
+	path string
+	// answers are only secure if trusted
+	trusted bool
+
+	records map[string][]dns.RR
+	modTime time.Time
+	checked time.Time
+	sync.RWMutex
+}
+
+// NewLocalZone loads the zone file at path
+// creating an example file if it doesn't exist
+func NewLocalZone(path string, trusted bool) (*LocalZone, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := ioutil.WriteFile(path, []byte(localZoneTemplate), 0644); err != nil {
+			return nil, fmt.Errorf("failed creating local zone: %v", err)
+		}
+	}
+
+	z := &LocalZone{
+		path:    path,
+		trusted: trusted,
+		records: make(map[string][]dns.RR),
+	}
+
+	if err := z.reload(); err != nil {
+		return nil, err
+	}
+
+	return z, nil
+}
+
+func parseLocalZone(data, path string) (map[string][]dns.RR, error) {
+	zp := dns.NewZoneParser(strings.NewReader(data), ".", path)
+	zp.SetDefaultTTL(localZoneDefaultTTL)
+
+	records := make(map[string][]dns.RR)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed parsing local zone: %v", err)
+	}
+
+	return records, nil
+}
+
+// reload parses the zone file if it changed
+// since it was last read
+func (z *LocalZone) reload() error {
+	info, err := os.Stat(z.path)
+	if err != nil {
+		return fmt.Errorf("failed reading local zone: %v", err)
+	}
+
+	z.Lock()
+	defer z.Unlock()
+
+	z.checked = time.Now()
+	if info.ModTime().Equal(z.modTime) {
+		return nil
+	}
+
+	// keep the last good records on errors
+	z.modTime = info.ModTime()
+
+	data, err := ioutil.ReadFile(z.path)
+	if err != nil {
+		return fmt.Errorf("failed reading local zone: %v", err)
+	}
+
+	records, err := parseLocalZone(string(data), z.path)
+	if err != nil {
+		return err
+	}
+
+	z.records = records
+	return nil
+}
+
+func (z *LocalZone) maybeReload() {
+	z.RLock()
+	due := time.Since(z.checked) > localZoneCheckInterval
+	z.RUnlock()
+
+	if !due {
+		return
+	}
+
+	if err := z.reload(); err != nil {
+		log.Printf("[WARN] local zone: %v", err)
+	}
+}
+
+// find returns records owned by name or
+// the closest matching wildcard
+func (z *LocalZone) find(name string) ([]dns.RR, bool) {
+	if rrs, ok := z.records[name]; ok {
+		return rrs, true
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		wildcard := "*." + name[off:]
+		if rrs, ok := z.records[wildcard]; ok {
+			return synthesizeWildcard(rrs, name), true
+		}
+
+		// an existing name stops the wildcard search
+		if _, ok := z.records[name[off:]]; ok {
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+func synthesizeWildcard(rrs []dns.RR, name string) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+		out[i].Header().Name = name
+	}
+
+	return out
+}
+
+// lookup returns the local answer for name including any CNAME
+// chain and the target to resolve elsewhere if the chain leaves
+// the zone. ok is false if the zone has nothing for name.
+func (z *LocalZone) lookup(name string, qtype uint16) (rrs []dns.RR, target string, ok bool) {
+	z.maybeReload()
+
+	z.RLock()
+	defer z.RUnlock()
+
+	name = dns.CanonicalName(name)
+	for i := 0; i <= maxLocalCNAMEs; i++ {
+		owned, found := z.find(name)
+		if !found {
+			if i == 0 {
+				return nil, "", false
+			}
+
+			return rrs, name, true
+		}
+
+		var cname *dns.CNAME
+		for _, rr := range owned {
+			if rr.Header().Rrtype == qtype {
+				rrs = append(rrs, rr)
+			}
+			if c, isCNAME := rr.(*dns.CNAME); isCNAME {
+				cname = c
+			}
+		}
+
+		if cname == nil || qtype == dns.TypeCNAME {
+			// names in the zone without
+			// qtype records have no data
+			return rrs, "", true
+		}
+
+		rrs = append(rrs, cname)
+		name = dns.CanonicalName(cname.Target)
+	}
+
+	return rrs, "", true
+}
+
+// SetLocalZone answers names in z before any network lookup
+func (h *HIP5Resolver) SetLocalZone(z *LocalZone) {
+	h.localZone = z
+}
+
+// queryLocal returns the answer from the local zone
+// or nil if it has nothing for name
+func (h *HIP5Resolver) queryLocal(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+	if h.localZone == nil {
+		return nil
+	}
+
+	rrs, target, ok := h.localZone.lookup(name, qtype)
+	if !ok {
+		return nil
+	}
+
+	traceStep(ctx, TraceStep{Kind: traceLocal, Name: name, qtype: qtype, rrs: rrs,
+		Detail: fmt.Sprintf("trusted: %v", h.localZone.trusted)})
+
+	res := &resolver.DNSResult{
+		Records: rrs,
+		Secure:  h.localZone.trusted,
+	}
+
+	if target != "" {
+		// target isn't in the zone
+		targetRes := h.query(ctx, target, qtype)
+		if targetRes.Err != nil {
+			return targetRes
+		}
+
+		res.Records = append(res.Records, targetRes.Records...)
+		res.Secure = res.Secure && targetRes.Secure
+	}
+
+	return res
+}
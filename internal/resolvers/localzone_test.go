@@ -0,0 +1,149 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const testLocalZone = `
+$TTL 300
+mysite.            IN A     127.0.0.1
+www.mysite.        IN CNAME mysite.
+*.staging.mysite.  IN A     10.0.0.2
+away.mysite.       IN CNAME example.
+`
+
+func newLocalZoneTestResolver(t *testing.T, trusted bool) (*HIP5Resolver, string) {
+	h := testStubResolver("example. 300 IN A 127.0.0.5")
+	file := testFile(t, "local.zone", testLocalZone)
+
+	z, err := NewLocalZone(file, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetLocalZone(z)
+
+	return h, file
+}
+
+func TestHIP5LocalZone(t *testing.T) {
+	h, _ := newLocalZoneTestResolver(t, false)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		records []string
+	}{
+		{"mysite.", dns.TypeA, []string{"mysite.\t300\tIN\tA\t127.0.0.1"}},
+		{"mysite.", dns.TypeAAAA, nil},
+		{"www.mysite.", dns.TypeA, []string{"www.mysite.\t300\tIN\tCNAME\tmysite.", "mysite.\t300\tIN\tA\t127.0.0.1"}},
+		{"a.staging.mysite.", dns.TypeA, []string{"a.staging.mysite.\t300\tIN\tA\t10.0.0.2"}},
+		{"away.mysite.", dns.TypeA, []string{"away.mysite.\t300\tIN\tCNAME\texample.", "example.\t300\tIN\tA\t127.0.0.5"}},
+	}
+
+	for _, test := range tests {
+		res := h.query(context.Background(), test.name, test.qtype)
+		if res.Err != nil {
+			t.Fatalf("%s: %v", test.name, res.Err)
+		}
+
+		if res.Secure {
+			t.Fatalf("%s: got secure answer from an untrusted zone", test.name)
+		}
+
+		if len(res.Records) != len(test.records) {
+			t.Fatalf("%s: got records = %v, want %v", test.name, res.Records, test.records)
+		}
+
+		for i, rr := range res.Records {
+			if rr.String() != test.records[i] {
+				t.Fatalf("%s: got record = %s, want %s", test.name, rr.String(), test.records[i])
+			}
+		}
+	}
+
+	// not in the zone
+	if res := h.query(context.Background(), "other.", dns.TypeA); res.Err == nil {
+		t.Fatalf("got records = %v, want lookup to go upstream", res.Records)
+	}
+}
+
+func TestHIP5LocalZoneTrusted(t *testing.T) {
+	h, _ := newLocalZoneTestResolver(t, true)
+
+	if res := h.query(context.Background(), "mysite.", dns.TypeA); res.Err != nil || !res.Secure {
+		t.Fatalf("got secure = %v err = %v, want secure answer", res.Secure, res.Err)
+	}
+
+	// secure as long as the target is secure
+	if res := h.query(context.Background(), "away.mysite.", dns.TypeA); res.Err != nil || !res.Secure {
+		t.Fatalf("got secure = %v err = %v, want secure answer", res.Secure, res.Err)
+	}
+}
+
+func TestHIP5NeedsSync(t *testing.T) {
+	h, _ := newLocalZoneTestResolver(t, false)
+	h.SetForwardRules([]ForwardRule{{Suffix: "corp.", Net: "udp", Addr: "10.0.0.1:53"}})
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"mysite.", false},
+		{"www.mysite.", false},
+		{"a.staging.mysite.", false},
+		{"www.corp.", false},
+		// the chain leaves the zone
+		{"away.mysite.", true},
+		{"other.", true},
+	}
+
+	for _, test := range tests {
+		if got := h.NeedsSync(test.name); got != test.want {
+			t.Fatalf("%s: got needs sync = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLocalZoneReload(t *testing.T) {
+	h, file := newLocalZoneTestResolver(t, false)
+
+	if err := ioutil.WriteFile(file, []byte("mysite. 300 IN A 127.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	// checked recently
+	res := h.query(context.Background(), "mysite.", dns.TypeA)
+	if res.Err != nil || res.Records[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("got records = %v err = %v, want old answer", res.Records, res.Err)
+	}
+
+	h.localZone.checked = time.Time{}
+	res = h.query(context.Background(), "mysite.", dns.TypeA)
+	if res.Err != nil || res.Records[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Fatalf("got records = %v err = %v, want new answer", res.Records, res.Err)
+	}
+
+	// bad files keep the last good records
+	if err := ioutil.WriteFile(file, []byte("mysite. IN BOGUS\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	h.localZone.checked = time.Time{}
+	res = h.query(context.Background(), "mysite.", dns.TypeA)
+	if res.Err != nil || res.Records[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Fatalf("got records = %v err = %v, want last good answer", res.Records, res.Err)
+	}
+}
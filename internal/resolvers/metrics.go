@@ -0,0 +1,247 @@
+package resolvers
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// query latency histogram buckets in seconds
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// resolution paths other than extensions
+// which use the extension name e.g. _eth
+const (
+	metricPathStub    = "stub"
+	metricPathNS      = "ns"
+	metricPathForward = "forward"
+)
+
+// dnssec validation results
+const (
+	dnssecSecure = iota
+	dnssecInsecure
+	dnssecBogus
+	dnssecResults
+)
+
+var dnssecResultNames = [dnssecResults]string{"secure", "insecure", "bogus"}
+
+// ProcStats hnsd state exported as metrics
+type ProcStats struct {
+	Height   uint64
+	Synced   bool
+	Restarts uint64
+}
+
+type pathMetrics struct {
+	ok      uint64
+	failed  uint64
+	buckets []uint64
+	sum     float64
+}
+
+// Metrics collects resolver counters and writes them
+// in the Prometheus text format. A nil *Metrics
+// ignores everything so it's optional.
+type Metrics struct {
+	paths map[string]*pathMetrics
+	mu    sync.Mutex
+
+	dnssec    [dnssecResults]uint64
+	rpcErrors uint64
+
+	cacheStats func() map[string]CacheStats
+	procStats  func() ProcStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		paths: make(map[string]*pathMetrics),
+	}
+}
+
+// SetCacheStats exports hit and miss counts of caches
+func (m *Metrics) SetCacheStats(s func() map[string]CacheStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cacheStats = s
+}
+
+// SetProcStats exports hnsd block height, sync state and restarts
+func (m *Metrics) SetProcStats(s func() ProcStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.procStats = s
+}
+
+func (m *Metrics) observeQuery(path string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	elapsed := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.paths[path]
+	if !ok {
+		p = &pathMetrics{buckets: make([]uint64, len(metricBuckets))}
+		m.paths[path] = p
+	}
+
+	if err != nil {
+		p.failed++
+	} else {
+		p.ok++
+	}
+
+	p.sum += elapsed
+	for i, le := range metricBuckets {
+		if elapsed <= le {
+			p.buckets[i]++
+		}
+	}
+}
+
+func (m *Metrics) observeDNSSEC(secure bool, err error) {
+	if m == nil {
+		return
+	}
+
+	result := dnssecInsecure
+	if err != nil {
+		result = dnssecBogus
+	} else if secure {
+		result = dnssecSecure
+	}
+
+	atomic.AddUint64(&m.dnssec[result], 1)
+}
+
+func (m *Metrics) observeRPCError() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.rpcErrors, 1)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return fmt.Sprint(v)
+}
+
+// WritePrometheus writes all metrics to w
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	procStats, cacheStats := m.procStats, m.cacheStats
+
+	names := make([]string, 0, len(m.paths))
+	for name := range m.paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP fingertip_queries_total Queries by resolution path and result.")
+	fmt.Fprintln(w, "# TYPE fingertip_queries_total counter")
+	for _, name := range names {
+		p := m.paths[name]
+		fmt.Fprintf(w, "fingertip_queries_total{path=%q,result=\"ok\"} %d\n", name, p.ok)
+		fmt.Fprintf(w, "fingertip_queries_total{path=%q,result=\"error\"} %d\n", name, p.failed)
+	}
+
+	fmt.Fprintln(w, "# HELP fingertip_query_duration_seconds Query latency by resolution path.")
+	fmt.Fprintln(w, "# TYPE fingertip_query_duration_seconds histogram")
+	for _, name := range names {
+		p := m.paths[name]
+		for i, le := range metricBuckets {
+			fmt.Fprintf(w, "fingertip_query_duration_seconds_bucket{path=%q,le=%q} %d\n",
+				name, formatMetricValue(le), p.buckets[i])
+		}
+		fmt.Fprintf(w, "fingertip_query_duration_seconds_bucket{path=%q,le=\"+Inf\"} %d\n", name, p.ok+p.failed)
+		fmt.Fprintf(w, "fingertip_query_duration_seconds_sum{path=%q} %s\n", name, formatMetricValue(p.sum))
+		fmt.Fprintf(w, "fingertip_query_duration_seconds_count{path=%q} %d\n", name, p.ok+p.failed)
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fingertip_dnssec_validations_total DNSSEC validation results.")
+	fmt.Fprintln(w, "# TYPE fingertip_dnssec_validations_total counter")
+	for i, name := range dnssecResultNames {
+		fmt.Fprintf(w, "fingertip_dnssec_validations_total{result=%q} %d\n", name, atomic.LoadUint64(&m.dnssec[i]))
+	}
+
+	fmt.Fprintln(w, "# HELP fingertip_ethereum_rpc_errors_total Failed Ethereum RPC calls.")
+	fmt.Fprintln(w, "# TYPE fingertip_ethereum_rpc_errors_total counter")
+	fmt.Fprintf(w, "fingertip_ethereum_rpc_errors_total %d\n", atomic.LoadUint64(&m.rpcErrors))
+
+	if cacheStats != nil {
+		stats := cacheStats()
+		caches := make([]string, 0, len(stats))
+		for name := range stats {
+			caches = append(caches, name)
+		}
+		sort.Strings(caches)
+
+		fmt.Fprintln(w, "# HELP fingertip_cache_hits_total Cache hits.")
+		fmt.Fprintln(w, "# TYPE fingertip_cache_hits_total counter")
+		for _, name := range caches {
+			fmt.Fprintf(w, "fingertip_cache_hits_total{cache=%q} %d\n", name, stats[name].Hits)
+		}
+
+		fmt.Fprintln(w, "# HELP fingertip_cache_misses_total Cache misses.")
+		fmt.Fprintln(w, "# TYPE fingertip_cache_misses_total counter")
+		for _, name := range caches {
+			fmt.Fprintf(w, "fingertip_cache_misses_total{cache=%q} %d\n", name, stats[name].Misses)
+		}
+
+		fmt.Fprintln(w, "# HELP fingertip_cache_entries Entries in each cache.")
+		fmt.Fprintln(w, "# TYPE fingertip_cache_entries gauge")
+		for _, name := range caches {
+			fmt.Fprintf(w, "fingertip_cache_entries{cache=%q} %d\n", name, stats[name].Size)
+		}
+	}
+
+	if procStats != nil {
+		s := procStats()
+		synced := 0
+		if s.Synced {
+			synced = 1
+		}
+
+		fmt.Fprintln(w, "# HELP fingertip_hnsd_block_height Current hnsd block height.")
+		fmt.Fprintln(w, "# TYPE fingertip_hnsd_block_height gauge")
+		fmt.Fprintf(w, "fingertip_hnsd_block_height %d\n", s.Height)
+		fmt.Fprintln(w, "# HELP fingertip_hnsd_synced Whether hnsd is synced.")
+		fmt.Fprintln(w, "# TYPE fingertip_hnsd_synced gauge")
+		fmt.Fprintf(w, "fingertip_hnsd_synced %d\n", synced)
+		fmt.Fprintln(w, "# HELP fingertip_hnsd_restarts_total Times hnsd was restarted after crashing.")
+		fmt.Fprintln(w, "# TYPE fingertip_hnsd_restarts_total counter")
+		fmt.Fprintf(w, "fingertip_hnsd_restarts_total %d\n", s.Restarts)
+	}
+}
+
+// SetMetrics records query and validation metrics in m
+func (h *HIP5Resolver) SetMetrics(m *Metrics) {
+	h.metrics = m
+}
+
+// SetMetrics records RPC errors in m
+func (e *Ethereum) SetMetrics(m *Metrics) {
+	e.metrics = m
+}
+
+// SetMetrics records validation results in m
+func (d *DoHExtension) SetMetrics(m *Metrics) {
+	d.metrics = m
+}
@@ -0,0 +1,107 @@
+package resolvers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWritePrometheus(t *testing.T) {
+	m := NewMetrics()
+	m.SetProcStats(func() ProcStats {
+		return ProcStats{Height: 100, Synced: true, Restarts: 2}
+	})
+	m.SetCacheStats(func() map[string]CacheStats {
+		return map[string]CacheStats{"tld": {Size: 3, Hits: 5, Misses: 1}}
+	})
+
+	m.observeQuery("_eth", time.Now().Add(-time.Second), nil)
+	m.observeQuery("_eth", time.Now(), errors.New("failed"))
+	m.observeDNSSEC(true, nil)
+	m.observeDNSSEC(false, errors.New("bad signature"))
+	m.observeRPCError()
+
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		`fingertip_queries_total{path="_eth",result="ok"} 1`,
+		`fingertip_queries_total{path="_eth",result="error"} 1`,
+		`fingertip_query_duration_seconds_bucket{path="_eth",le="0.005"} 1`,
+		`fingertip_query_duration_seconds_bucket{path="_eth",le="+Inf"} 2`,
+		`fingertip_query_duration_seconds_count{path="_eth"} 2`,
+		`fingertip_dnssec_validations_total{result="secure"} 1`,
+		`fingertip_dnssec_validations_total{result="insecure"} 0`,
+		`fingertip_dnssec_validations_total{result="bogus"} 1`,
+		`fingertip_ethereum_rpc_errors_total 1`,
+		`fingertip_cache_hits_total{cache="tld"} 5`,
+		`fingertip_cache_misses_total{cache="tld"} 1`,
+		`fingertip_hnsd_block_height 100`,
+		`fingertip_hnsd_synced 1`,
+		`fingertip_hnsd_restarts_total 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out)
+		}
+	}
+
+	// nil metrics are ignored
+	var nilMetrics *Metrics
+	nilMetrics.observeQuery(metricPathStub, time.Now(), nil)
+	nilMetrics.observeDNSSEC(true, nil)
+	nilMetrics.observeRPCError()
+}
+
+func TestHIP5Metrics(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			switch name {
+			case "bogus.":
+				return &resolver.DNSResult{Err: resolver.ErrServFail}
+			case "signed.":
+				return &resolver.DNSResult{Records: []dns.RR{testRR(name + " 300 IN A 127.0.0.1")}, Secure: true}
+			}
+			return &resolver.DNSResult{Records: []dns.RR{testRR(name + " 300 IN A 127.0.0.1")}}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	// no hip-5 records
+	h.exchangeRoot = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeNameError)
+		return r, 0, nil
+	}
+	m := NewMetrics()
+	h.SetMetrics(m)
+
+	for i := 0; i < 3; i++ {
+		if res := h.query(context.Background(), "example.", dns.TypeA); res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+
+	h.query(context.Background(), "signed.", dns.TypeA)
+	h.query(context.Background(), "bogus.", dns.TypeA)
+
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf)
+	for _, line := range []string{
+		`fingertip_queries_total{path="stub",result="ok"} 4`,
+		`fingertip_dnssec_validations_total{result="secure"} 1`,
+		`fingertip_dnssec_validations_total{result="insecure"} 3`,
+		`fingertip_dnssec_validations_total{result="bogus"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package resolvers
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// initial srtt for servers we haven't talked to yet
+	// kept low so that new servers get a chance
+	initialRTT = 50 * time.Millisecond
+	// the rtt recorded for a timed out query
+	timeoutRTT = 2 * time.Second
+	// delay before racing the next nameserver
+	minStagger = 100 * time.Millisecond
+	maxStagger = 400 * time.Millisecond
+	// backoff for servers that keep timing out
+	maxBackoff = 5 * time.Minute
+	// forget servers we haven't used in a while
+	serverStatsTTL = 30 * time.Minute
+	maxServerStats = 2000
+	// how long to skip ipv6 servers after
+	// finding there's no ipv6 connectivity
+	ipv6RetryInterval = 5 * time.Minute
+)
+
+type serverInfo struct {
+	srtt         time.Duration
+	failures     int
+	backoffUntil time.Time
+	lastUsed     time.Time
+
+	// spoofing protections the server supports
+	case0x20     int
+	serverCookie string
+}
+
+// serverStats tracks a smoothed round trip time
+// for each nameserver address similar to
+// BIND's SRTT based server selection.
+type serverStats struct {
+	m map[string]*serverInfo
+	// ipv6 servers are skipped until then
+	// unless there are no ipv4 servers
+	ipv6DownUntil time.Time
+	// used to derive client cookies
+	cookieSecret []byte
+	sync.RWMutex
+}
+
+func newServerStats() *serverStats {
+	// if this fails cookies still work
+	// but are easier to guess
+	secret := make([]byte, 16)
+	_, _ = crand.Read(secret)
+
+	return &serverStats{
+		m:            make(map[string]*serverInfo),
+		cookieSecret: secret,
+	}
+}
+
+func (s *serverStats) info(addr string) serverInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	if i, ok := s.m[addr]; ok {
+		return *i
+	}
+
+	// spread unknown servers slightly
+	// so they are not always tried in the same order
+	return serverInfo{
+		srtt: initialRTT + time.Duration(rand.Int63n(int64(initialRTT/5))),
+	}
+}
+
+func (s *serverStats) getOrCreate(addr string) *serverInfo {
+	i, ok := s.m[addr]
+	if ok {
+		return i
+	}
+
+	if len(s.m) >= maxServerStats {
+		s.prune()
+	}
+
+	i = &serverInfo{srtt: initialRTT}
+	s.m[addr] = i
+	return i
+}
+
+// prune removes stale entries must be called
+// with the lock held
+func (s *serverStats) prune() {
+	now := time.Now()
+	for addr, i := range s.m {
+		if now.Sub(i.lastUsed) > serverStatsTTL {
+			delete(s.m, addr)
+		}
+	}
+
+	// still full drop an arbitrary entry
+	if len(s.m) >= maxServerStats {
+		for addr := range s.m {
+			delete(s.m, addr)
+			break
+		}
+	}
+}
+
+// success records a response received after rtt
+func (s *serverStats) success(addr string, rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	i := s.getOrCreate(addr)
+	i.srtt = (7*i.srtt + 3*rtt) / 10
+	i.failures = 0
+	i.backoffUntil = time.Time{}
+	i.lastUsed = time.Now()
+
+	if isIPv6Addr(addr) {
+		s.ipv6DownUntil = time.Time{}
+	}
+}
+
+// unreachable checks if err shows this host has no
+// route for the address family of addr. Only ipv6 is
+// tracked since ipv4 is assumed to always be available.
+func (s *serverStats) unreachable(addr string, err error) {
+	if !isIPv6Addr(addr) || !isUnreachable(err) {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.ipv6DownUntil = time.Now().Add(ipv6RetryInterval)
+}
+
+func (s *serverStats) ipv6Down() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return time.Now().Before(s.ipv6DownUntil)
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+// isIPv6Addr checks if a host:port address is ipv6
+func isIPv6Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// nsAddr formats ip as a host:port address
+func nsAddr(ip net.IP, port string) string {
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// failure penalizes a server that timed out
+// or returned an unusable response
+func (s *serverStats) failure(addr string) {
+	s.Lock()
+	defer s.Unlock()
+
+	i := s.getOrCreate(addr)
+	i.srtt = (7*i.srtt + 3*timeoutRTT) / 10
+	if i.failures < 16 {
+		i.failures++
+	}
+
+	backoff := time.Second << (i.failures - 1)
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	i.backoffUntil = time.Now().Add(backoff)
+	i.lastUsed = time.Now()
+}
+
+// sort orders addrs by preference fastest first.
+// Servers in backoff are moved to the end but
+// still used as a last resort.
+func (s *serverStats) sort(addrs []string) []string {
+	now := time.Now()
+	infos := make(map[string]serverInfo, len(addrs))
+	for _, addr := range addrs {
+		infos[addr] = s.info(addr)
+	}
+
+	sorted := make([]string, len(addrs))
+	copy(sorted, addrs)
+
+	sort.SliceStable(sorted, func(a, b int) bool {
+		ia, ib := infos[sorted[a]], infos[sorted[b]]
+		backoffA, backoffB := now.Before(ia.backoffUntil), now.Before(ib.backoffUntil)
+		if backoffA != backoffB {
+			return backoffB
+		}
+
+		return ia.srtt < ib.srtt
+	})
+
+	return sorted
+}
+
+// order sorts addrs by preference then alternates
+// address families starting with the family of the
+// best server so a broken family only delays the
+// answer by a stagger (RFC8305 section 4). IPv6 servers
+// are dropped if ipv6 isn't working.
+func (s *serverStats) order(addrs []string) []string {
+	sorted := s.sort(addrs)
+	if len(sorted) == 0 {
+		return sorted
+	}
+
+	var v4, v6 []string
+	for _, addr := range sorted {
+		if isIPv6Addr(addr) {
+			v6 = append(v6, addr)
+			continue
+		}
+
+		v4 = append(v4, addr)
+	}
+
+	if len(v4) > 0 && s.ipv6Down() {
+		return v4
+	}
+
+	first, second := v4, v6
+	if isIPv6Addr(sorted[0]) {
+		first, second = v6, v4
+	}
+
+	ordered := make([]string, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			ordered = append(ordered, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			ordered = append(ordered, second[0])
+			second = second[1:]
+		}
+	}
+
+	return ordered
+}
+
+// stagger returns how long to wait for addr
+// before racing the next server
+func (s *serverStats) stagger(addr string) time.Duration {
+	d := 2 * s.info(addr).srtt
+	if d < minStagger {
+		return minStagger
+	}
+	if d > maxStagger {
+		return maxStagger
+	}
+
+	return d
+}
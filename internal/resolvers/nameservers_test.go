@@ -0,0 +1,236 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerStatsSort(t *testing.T) {
+	s := newServerStats()
+	s.success("fast:53", 10*time.Millisecond)
+	s.success("slow:53", 300*time.Millisecond)
+	s.failure("dead:53")
+
+	got := s.sort([]string{"dead:53", "slow:53", "new:53", "fast:53"})
+	want := []string{"fast:53", "new:53", "slow:53", "dead:53"}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got order = %v, want %v", got, want)
+		}
+	}
+
+	// backoff grows with each failure
+	s.failure("dead:53")
+	if until := s.info("dead:53").backoffUntil; time.Until(until) < time.Second {
+		t.Fatalf("got backoff until = %v, want at least 1s from now", until)
+	}
+}
+
+func TestHIP5RaceExchange(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+
+	var mu sync.Mutex
+	var queried []string
+
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		mu.Lock()
+		queried = append(queried, a)
+		mu.Unlock()
+
+		switch a {
+		case "127.0.0.1:53":
+			// unresponsive server
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		case "127.0.0.2:53":
+			return nil, 0, errors.New("connection refused")
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = []dns.RR{testRR(m.Question[0].Name + " 300 IN A 127.0.0.10")}
+		return r, 5 * time.Millisecond, nil
+	}
+
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}
+
+	start := time.Now()
+	msg, err := h.exchangeNS(context.Background(), ips, "example.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 {
+		t.Fatalf("got answers = %d, want 1", len(msg.Answer))
+	}
+
+	// an unresponsive server must not
+	// delay the answer by the full timeout
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got elapsed = %v, want less than 1s", elapsed)
+	}
+
+	// the responsive server is preferred next time
+	sorted := h.nsStats.sort([]string{"127.0.0.1:53", "127.0.0.2:53", "127.0.0.3:53"})
+	if sorted[0] != "127.0.0.3:53" {
+		t.Fatalf("got order = %v", sorted)
+	}
+
+	mu.Lock()
+	queried = nil
+	mu.Unlock()
+
+	if _, err = h.exchangeNS(context.Background(), ips, "example.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queried) != 1 || queried[0] != "127.0.0.3:53" {
+		t.Fatalf("got queried = %v, want only 127.0.0.3:53", queried)
+	}
+}
+
+func TestExchangeFuncCancel(t *testing.T) {
+	// never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	exchange := newExchangeFunc("udp", 4*time.Second, nil)
+	m := new(dns.Msg)
+	m.SetQuestion("example.", dns.TypeA)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			if _, _, err := exchange(ctx, m, pc.LocalAddr().String()); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got err = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("exchange took %v after ctx was done", elapsed)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestNSAddr(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1":        "127.0.0.1:53",
+		"::ffff:127.0.0.1": "127.0.0.1:53",
+		"2001:db8::1":      "[2001:db8::1]:53",
+	}
+
+	for ip, want := range tests {
+		addr := nsAddr(net.ParseIP(ip), "53")
+		if addr != want {
+			t.Fatalf("got addr = %s, want %s", addr, want)
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerStatsOrder(t *testing.T) {
+	s := newServerStats()
+	s.success("[2001:db8::1]:53", 5*time.Millisecond)
+	s.success("127.0.0.1:53", 10*time.Millisecond)
+	s.success("127.0.0.2:53", 20*time.Millisecond)
+
+	// best server first then alternating families
+	got := s.order([]string{"127.0.0.1:53", "127.0.0.2:53", "[2001:db8::2]:53", "[2001:db8::1]:53"})
+	want := []string{"[2001:db8::1]:53", "127.0.0.1:53", "[2001:db8::2]:53", "127.0.0.2:53"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHIP5DualStackExchange(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+
+	var mu sync.Mutex
+	var queried []string
+
+	// host without ipv6 connectivity
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		mu.Lock()
+		queried = append(queried, a)
+		mu.Unlock()
+
+		if isIPv6Addr(a) {
+			return nil, 0, &net.OpError{Op: "dial", Net: "udp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = []dns.RR{testRR(m.Question[0].Name + " 300 IN A 127.0.0.10")}
+		return r, 5 * time.Millisecond, nil
+	}
+
+	v6 := []net.IP{net.ParseIP("2001:db8::1")}
+	if _, err := h.exchangeNS(context.Background(), v6, "example.", dns.TypeA); err == nil {
+		t.Fatal("want error")
+	}
+
+	mu.Lock()
+	if len(queried) != 1 || queried[0] != "[2001:db8::1]:53" {
+		t.Fatalf("got queried = %v, want [2001:db8::1]:53", queried)
+	}
+	queried = nil
+	mu.Unlock()
+
+	if !h.nsStats.ipv6Down() {
+		t.Fatal("want ipv6 marked as down")
+	}
+
+	// ipv4 is preferred now
+	ips := append(v6, net.ParseIP("127.0.0.1"))
+	if _, err := h.exchangeNS(context.Background(), ips, "example.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queried) != 1 || queried[0] != "127.0.0.1:53" {
+		t.Fatalf("got queried = %v, want only 127.0.0.1:53", queried)
+	}
+}
@@ -0,0 +1,162 @@
+package resolvers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Persistent cache
+// entries are saved with their expiry on close
+// and restored on start so lookups made before
+// a restart don't have to be repeated
+
+const cacheFileVersion = 1
+
+type persistedEntry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	Records []string  `json:"records,omitempty"`
+
+	// dnskey sets
+	Addrs []string `json:"addrs,omitempty"`
+	DS    []string `json:"ds,omitempty"`
+
+	// ens lookups
+	Registry string `json:"registry,omitempty"`
+	Resolver string `json:"resolver,omitempty"`
+	Node     string `json:"node,omitempty"`
+}
+
+type cacheFile struct {
+	Version int                         `json:"version"`
+	Caches  map[string][]persistedEntry `json:"caches"`
+}
+
+func newCacheFile() *cacheFile {
+	return &cacheFile{
+		Version: cacheFileVersion,
+		Caches:  make(map[string][]persistedEntry),
+	}
+}
+
+// readCacheFile returns an empty cache file
+// if path doesn't exist or has an older version
+func readCacheFile(path string) (*cacheFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return newCacheFile(), nil
+		}
+		return nil, fmt.Errorf("failed reading cache file: %v", err)
+	}
+
+	f := newCacheFile()
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("failed parsing cache file: %v", err)
+	}
+
+	if f.Version != cacheFileVersion {
+		return newCacheFile(), nil
+	}
+
+	return f, nil
+}
+
+// writeCacheFile replaces path atomically
+func writeCacheFile(path string, f *cacheFile) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed encoding cache file: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed writing cache file: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed writing cache file: %v", err)
+	}
+
+	return nil
+}
+
+// saveCache converts all entries in c that are still
+// within the max stale window using encode
+func saveCache(c *cache, encode func(key string, e *entry) (persistedEntry, bool)) []persistedEntry {
+	var out []persistedEntry
+
+	for _, item := range c.snapshot() {
+		if time.Now().After(item.ttl.Add(c.maxStaleWindow())) {
+			continue
+		}
+
+		p, ok := encode(item.key, item.entry)
+		if !ok {
+			continue
+		}
+
+		p.Key = item.key
+		p.Expires = item.ttl
+		out = append(out, p)
+	}
+
+	return out
+}
+
+// loadCache restores entries into c using decode
+// entries that can't be decoded are skipped
+func loadCache(c *cache, entries []persistedEntry, decode func(p persistedEntry) (interface{}, error)) {
+	for _, p := range entries {
+		if time.Now().After(p.Expires.Add(c.maxStaleWindow())) {
+			continue
+		}
+
+		msg, err := decode(p)
+		if err != nil {
+			continue
+		}
+
+		c.set(p.Key, &entry{
+			msg: msg,
+			ttl: p.Expires,
+		})
+	}
+}
+
+func encodeRRs(rrs []dns.RR) []string {
+	out := make([]string, len(rrs))
+	for i, rr := range rrs {
+		out[i] = rr.String()
+	}
+
+	return out
+}
+
+func decodeRRs(records []string) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, errors.New("empty record")
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+func cacheName(prefix string, qtype uint16) string {
+	return prefix + "_" + strings.ToLower(dns.TypeToString[qtype])
+}
@@ -0,0 +1,72 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHIP5CacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fingertip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "hip5.cache")
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	synced := true
+	newResolver := func() *HIP5Resolver {
+		h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+			return synced
+		})
+		h.SetServeStale(time.Hour)
+		h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+			return []dns.RR{testRR("www.forever. 300 IN A 127.0.0.1")}, nil
+		})
+		if err := h.SetCacheFile(cacheFile); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h := newResolver()
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS persist._example.")})
+
+	res := h.query(context.Background(), "www.forever.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	h.Close()
+
+	// restart before hnsd is synced
+	synced = false
+	h = newResolver()
+	defer h.Close()
+	h.exchangeRoot = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		t.Fatal("unexpected root lookup")
+		return nil, 0, nil
+	}
+
+	if rrs, ok := h.checkTLDCache("forever."); !ok || len(rrs) != 1 || rrs[0].Ns != "persist._example." {
+		t.Fatalf("got tld cache = %v, want persist._example.", rrs)
+	}
+
+	// answers aren't persisted so
+	// queries still wait for sync
+	res = h.query(context.Background(), "www.forever.", dns.TypeA)
+	if res.Err != errNotSynced {
+		t.Fatalf("got err = %v, want %v", res.Err, errNotSynced)
+	}
+}
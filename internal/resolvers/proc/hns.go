@@ -24,6 +24,7 @@ type HNSProc struct {
 	lastHeightUpdate time.Time
 	synced           bool
 	retryCount       int
+	restarts         uint64
 	lastRetry        time.Time
 	sync.RWMutex
 }
@@ -167,9 +168,19 @@ func (h *HNSProc) IncrementRetries() {
 	defer h.Unlock()
 
 	h.retryCount += 1
+	h.restarts += 1
 	h.lastRetry = time.Now()
 }
 
+// Restarts returns the number of times hnsd was
+// restarted unlike Retries it's never reset
+func (h *HNSProc) Restarts() uint64 {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.restarts
+}
+
 func (h *HNSProc) SetHeight(height uint64) {
 	h.Lock()
 	defer h.Unlock()
@@ -0,0 +1,153 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// QNAME minimisation for hip-5 delegations
+// https://datatracker.ietf.org/doc/html/rfc9156
+
+// QNAMEMinimisation controls how much of the query
+// name is sent to nameservers of parent zones
+type QNAMEMinimisation int
+
+const (
+	// QNAMEMinimisationOff sends the full name to every server
+	QNAMEMinimisationOff QNAMEMinimisation = iota
+	// QNAMEMinimisationRelaxed sends the full name if a
+	// minimised query fails or returns NXDOMAIN since some
+	// servers answer NXDOMAIN for empty non-terminals
+	QNAMEMinimisationRelaxed
+	// QNAMEMinimisationStrict trusts NXDOMAIN for minimised
+	// names (RFC8020) and fails if a minimised query fails
+	QNAMEMinimisationStrict
+)
+
+const (
+	// RFC9156 section 2.3
+	maxMinimiseCount = 10
+	minimiseOneLab   = 4
+)
+
+var qnameMinimisationModes = map[string]QNAMEMinimisation{
+	"off":     QNAMEMinimisationOff,
+	"relaxed": QNAMEMinimisationRelaxed,
+	"strict":  QNAMEMinimisationStrict,
+}
+
+// ParseQNAMEMinimisation parses off, relaxed or strict
+func ParseQNAMEMinimisation(mode string) (QNAMEMinimisation, error) {
+	m, ok := qnameMinimisationModes[strings.ToLower(strings.TrimSpace(mode))]
+	if !ok {
+		return QNAMEMinimisationOff, fmt.Errorf("unknown qname minimisation mode `%s`", mode)
+	}
+
+	return m, nil
+}
+
+func (m QNAMEMinimisation) String() string {
+	for name, mode := range qnameMinimisationModes {
+		if mode == m {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// SetQNAMEMinimisation sets the mode used when
+// querying nameservers of hip-5 delegations
+func (h *HIP5Resolver) SetQNAMEMinimisation(mode QNAMEMinimisation) {
+	h.qmin = mode
+}
+
+// minimisedNames returns the ancestors of qname below zone
+// to query before qname itself. The first few add one label
+// at a time then larger steps keep the number of queries
+// below maxMinimiseCount.
+func minimisedNames(zone, qname string) []string {
+	labels := dns.CountLabel(zone)
+	total := dns.CountLabel(qname)
+	offsets := dns.Split(qname)
+
+	var names []string
+	for labels < total-1 && len(names) < maxMinimiseCount {
+		step := 1
+		if len(names) >= minimiseOneLab {
+			left := maxMinimiseCount - len(names)
+			step = (total - 1 - labels + left - 1) / left
+		}
+
+		labels += step
+		names = append(names, qname[offsets[total-labels]:])
+	}
+
+	return names
+}
+
+// isReferral checks if msg delegates
+// a child of zone to other servers
+func isReferral(msg *dns.Msg, zone string) bool {
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) > 0 {
+		return false
+	}
+
+	for _, rr := range msg.Ns {
+		if _, ok := rr.(*dns.NS); ok && !strings.EqualFold(rr.Header().Name, zone) &&
+			dns.IsSubDomain(zone, rr.Header().Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exchangeMinimised queries ancestors of qname below zone
+// until a referral is found then sends qname. It returns
+// the response to use and the question it answers which
+// is only a minimised one for referrals and strict NXDOMAIN.
+func (h *HIP5Resolver) exchangeMinimised(ctx context.Context, ips []net.IP, zone, qname string, qtype uint16) (*dns.Msg, string, uint16, error) {
+	if h.qmin == QNAMEMinimisationOff {
+		msg, err := h.exchangeNS(ctx, ips, qname, qtype)
+		return msg, qname, qtype, err
+	}
+
+	for _, name := range minimisedNames(zone, qname) {
+		// A rather than NS as recommended by RFC9156
+		// since some servers mishandle NS queries
+		msg, err := h.exchangeNS(ctx, ips, name, dns.TypeA)
+		if err == nil && isReferral(msg, zone) {
+			return msg, name, dns.TypeA, nil
+		}
+
+		if err == nil && msg.Rcode == dns.RcodeSuccess {
+			// empty non-terminal or
+			// name exists without a cut
+			continue
+		}
+
+		if h.qmin == QNAMEMinimisationStrict {
+			if err != nil {
+				return nil, "", 0, err
+			}
+
+			// nothing exists below
+			return msg, name, dns.TypeA, nil
+		}
+
+		reason := "nxdomain"
+		if err != nil {
+			reason = err.Error()
+		}
+		traceStep(ctx, TraceStep{Kind: traceNS, Name: name, qtype: dns.TypeA,
+			Detail: fmt.Sprintf("minimised query failed (%s) sending full name", reason)})
+		break
+	}
+
+	msg, err := h.exchangeNS(ctx, ips, qname, qtype)
+	return msg, qname, qtype, err
+}
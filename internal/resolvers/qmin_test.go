@@ -0,0 +1,154 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMinimisedNames(t *testing.T) {
+	tests := []struct {
+		zone, qname string
+		want        []string
+	}{
+		{"example.", "example.", nil},
+		{"example.", "www.example.", nil},
+		{"example.", "a.b.Example.", []string{"b.Example."}},
+		{"example.", "a.b.c.d.e.f.g.h.i.j.k.l.m.n.example.", []string{
+			"n.example.", "m.n.example.", "l.m.n.example.", "k.l.m.n.example.",
+			"i.j.k.l.m.n.example.", "g.h.i.j.k.l.m.n.example.", "e.f.g.h.i.j.k.l.m.n.example.",
+			"d.e.f.g.h.i.j.k.l.m.n.example.", "c.d.e.f.g.h.i.j.k.l.m.n.example.",
+			"b.c.d.e.f.g.h.i.j.k.l.m.n.example.",
+		}},
+	}
+
+	for _, test := range tests {
+		got := minimisedNames(test.zone, test.qname)
+		if len(got) != len(test.want) {
+			t.Fatalf("got names = %v, want %v", got, test.want)
+		}
+
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Fatalf("got names = %v, want %v", got, test.want)
+			}
+		}
+	}
+
+	// never more than maxMinimiseCount
+	long := "example."
+	for i := 0; i < 100; i++ {
+		long = "a." + long
+	}
+	if got := minimisedNames("example.", long); len(got) > maxMinimiseCount {
+		t.Fatalf("got %d names, want at most %d", len(got), maxMinimiseCount)
+	}
+}
+
+func TestHIP5QNAMEMinimisation(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+
+	var mu sync.Mutex
+	var queried []string
+	brokenENT := false
+
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		// names are sent with mixed case
+		q := m.Question[0]
+		q.Name = dns.CanonicalName(q.Name)
+		mu.Lock()
+		queried = append(queried, a+" "+q.Name)
+		mu.Unlock()
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+
+		switch {
+		case a == "127.0.0.1:53" && q.Name == "c.forever.":
+			if brokenENT {
+				r.Rcode = dns.RcodeNameError
+			}
+		case a == "127.0.0.1:53" && dns.IsSubDomain("b.c.forever.", q.Name):
+			r.Ns = []dns.RR{testRR("b.c.forever. 300 IN NS ns.b.c.forever.")}
+			r.Extra = []dns.RR{testRR("ns.b.c.forever. 300 IN A 127.0.0.2")}
+		case a == "127.0.0.2:53" && q.Name == "a.b.c.forever.":
+			r.Answer = []dns.RR{testRR("a.b.c.forever. 300 IN A 127.0.0.10")}
+		default:
+			r.Rcode = dns.RcodeNameError
+		}
+
+		return r, time.Millisecond, nil
+	}
+
+	ns := []*dns.NS{testRR("forever. 300 IN NS ns.forever.").(*dns.NS)}
+	glue := []dns.RR{testRR("ns.forever. 300 IN A 127.0.0.1")}
+
+	var info *QueryInfo
+	resolve := func() ([]dns.RR, error) {
+		mu.Lock()
+		queried = nil
+		mu.Unlock()
+
+		var ctx context.Context
+		ctx, info = WithQueryInfo(context.Background())
+		rrs, _, err := h.resolveNS(ctx, ns, nil, glue, "a.b.c.forever.", dns.TypeA, 0)
+		return rrs, err
+	}
+
+	rrs, err := resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 {
+		t.Fatalf("got records = %v, want 1", rrs)
+	}
+
+	// the parent never sees the full name
+	want := []string{"127.0.0.1:53 c.forever.", "127.0.0.1:53 b.c.forever.", "127.0.0.2:53 a.b.c.forever."}
+	if len(queried) != len(want) {
+		t.Fatalf("got queried = %v, want %v", queried, want)
+	}
+	for i := range want {
+		if queried[i] != want[i] {
+			t.Fatalf("got queried = %v, want %v", queried, want)
+		}
+	}
+
+	// relaxed falls back to the full name
+	brokenENT = true
+	if _, err = resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if queried[1] != "127.0.0.1:53 a.b.c.forever." {
+		t.Fatalf("got queried = %v, want full name after nxdomain", queried)
+	}
+
+	// strict trusts the nxdomain
+	h.SetQNAMEMinimisation(QNAMEMinimisationStrict)
+	if rrs, err = resolve(); err != nil || len(rrs) > 0 {
+		t.Fatalf("got records = %v, err = %v, want none", rrs, err)
+	}
+	if !info.NXDomain("a.b.c.forever.") {
+		t.Fatal("want nxdomain")
+	}
+
+	// off sends the full name right away
+	h.SetQNAMEMinimisation(QNAMEMinimisationOff)
+	if _, err = resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if queried[0] != "127.0.0.1:53 a.b.c.forever." {
+		t.Fatalf("got queried = %v, want full name", queried)
+	}
+}
@@ -0,0 +1,102 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync"
+)
+
+type queryInfoKey struct{}
+
+// QueryInfo collects details about how a query was answered
+// that don't fit in a resolver.DNSResult
+type QueryInfo struct {
+	stale bool
+	// negative answers by name
+	negative map[string]negativeAnswer
+	sync.Mutex
+}
+
+// negativeAnswer an NXDOMAIN or NODATA answer.
+// Resolvers return these as empty results.
+type negativeAnswer struct {
+	soa      *dns.SOA
+	nxdomain bool
+}
+
+// WithQueryInfo returns a context that records
+// details about queries resolved with it
+func WithQueryInfo(ctx context.Context) (context.Context, *QueryInfo) {
+	info := &QueryInfo{}
+	return context.WithValue(ctx, queryInfoKey{}, info), info
+}
+
+func queryInfoFromContext(ctx context.Context) *QueryInfo {
+	info, _ := ctx.Value(queryInfoKey{}).(*QueryInfo)
+	return info
+}
+
+// Stale reports whether any part of the answer
+// was served from expired cache data
+func (q *QueryInfo) Stale() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.stale
+}
+
+func markStale(ctx context.Context) {
+	if info := queryInfoFromContext(ctx); info != nil {
+		info.Lock()
+		info.stale = true
+		info.Unlock()
+	}
+}
+
+// NegativeSOA returns the SOA record from the negative
+// answer for name if one was seen
+func (q *QueryInfo) NegativeSOA(name string) (*dns.SOA, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	n := q.negative[dns.CanonicalName(name)]
+	return n.soa, n.soa != nil
+}
+
+// NXDomain reports whether name was
+// found not to exist
+func (q *QueryInfo) NXDomain(name string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.negative[dns.CanonicalName(name)].nxdomain
+}
+
+// markNegative keeps the rcode and SOA record of msg
+// if it's an NXDOMAIN or NODATA answer for name
+func markNegative(ctx context.Context, name string, msg *dns.Msg) {
+	info := queryInfoFromContext(ctx)
+	if info == nil || len(msg.Answer) > 0 {
+		return
+	}
+
+	n := negativeAnswer{nxdomain: msg.Rcode == dns.RcodeNameError}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			n.soa = soa
+			break
+		}
+	}
+
+	if n.soa == nil && !n.nxdomain {
+		return
+	}
+
+	info.Lock()
+	defer info.Unlock()
+
+	if info.negative == nil {
+		info.negative = make(map[string]negativeAnswer)
+	}
+	info.negative[dns.CanonicalName(name)] = n
+}
@@ -0,0 +1,162 @@
+// Package resolverstest provides in-process DNS servers for
+// testing HIP-5 resolution end-to-end without network access.
+package resolverstest
+
+import (
+	"context"
+	"fingertip/internal/resolvers"
+	"fingertip/internal/resolvers/internal/nsport"
+	"fmt"
+	"github.com/miekg/dns"
+	"strconv"
+	"sync"
+)
+
+const (
+	// ExtensionName the HIP-5 extension delegating
+	// names to the authoritative server
+	ExtensionName = "_test"
+
+	// NSName the nameserver of every HIP-5 zone
+	// resolved by the fake recursive resolver
+	NSName = "ns1.resolverstest."
+)
+
+// Harness runs a fake hnsd root server (--ns-host), a fake
+// hnsd recursive resolver (--rs-host) and an authoritative
+// server for HIP-5 zones. HIP-5 zones are delegated from
+// the root to ExtensionName which returns their NS and DS
+// records. Resolvers must register Extension() and
+// be passed to Use().
+type Harness struct {
+	Root      *Server
+	Recursive *Server
+	Auth      *Server
+
+	root *Zone
+	ext  *extension
+}
+
+// NewHarness starts the servers with empty zones
+func NewHarness() (*Harness, error) {
+	root, err := NewZone(".")
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := NewZone(NSName, NSName+" 300 IN A 127.0.0.1")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Harness{
+		root: root,
+		ext:  &extension{delegations: make(map[string][]dns.RR)},
+	}
+
+	if h.Root, err = NewServer(root); err != nil {
+		return nil, err
+	}
+
+	if h.Recursive, err = NewRecursiveServer(ns); err != nil {
+		h.Root.Close()
+		return nil, err
+	}
+
+	if h.Auth, err = NewServer(); err != nil {
+		h.Root.Close()
+		h.Recursive.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// AddRecursive serves z from the recursive resolver
+// for names resolved without HIP-5
+func (h *Harness) AddRecursive(z *Zone) {
+	h.Recursive.AddZone(z)
+}
+
+// AddHIP5 serves z from the authoritative server and delegates
+// it from the root using the extension. z must be a tld.
+func (h *Harness) AddHIP5(z *Zone) error {
+	if dns.CountLabel(z.Origin) != 1 {
+		return fmt.Errorf("zone %s must be a tld", z.Origin)
+	}
+
+	delegation := []dns.RR{&dns.NS{
+		Hdr: dns.RR_Header{Name: z.Origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+		Ns:  NSName,
+	}}
+	delegation = append(delegation, z.DS()...)
+
+	h.ext.Lock()
+	h.ext.delegations[z.Origin] = delegation
+	h.ext.Unlock()
+
+	err := h.root.Add(&dns.NS{
+		Hdr: dns.RR_Header{Name: z.Origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+		Ns:  dns.Fqdn(dns.SplitDomainName(z.Origin)[0] + "." + ExtensionName),
+	})
+	if err != nil {
+		return err
+	}
+
+	h.Auth.AddZone(z)
+	return nil
+}
+
+// Extension returns the extension resolving HIP-5 zones
+func (h *Harness) Extension() resolvers.Extension {
+	return h.ext
+}
+
+// Use sends queries of r for HIP-5
+// nameservers to the authoritative server
+func (h *Harness) Use(r *resolvers.HIP5Resolver) {
+	nsport.Set(r, strconv.Itoa(h.Auth.Port))
+}
+
+// Close stops all servers
+func (h *Harness) Close() {
+	h.Root.Close()
+	h.Recursive.Close()
+	h.Auth.Close()
+}
+
+// extension returns the delegation of a HIP-5 zone
+type extension struct {
+	delegations map[string][]dns.RR
+	sync.RWMutex
+}
+
+func (e *extension) Name() string {
+	return ExtensionName
+}
+
+func (e *extension) Handler(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	tld := dns.Fqdn(resolvers.LastNLabels(qname, 1))
+	rrs, ok := e.delegations[tld]
+	if !ok {
+		return nil, fmt.Errorf("no delegation for %s", tld)
+	}
+
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+	}
+
+	return out, nil
+}
+
+func (e *extension) CachePolicy() resolvers.CachePolicy {
+	return resolvers.CachePolicy{}
+}
+
+func (e *extension) HealthCheck(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package resolverstest_test
+
+import (
+	"context"
+	"fingertip/internal/resolvers"
+	"fingertip/internal/resolvers/resolverstest"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func newTestHarness(t *testing.T) (*resolverstest.Harness, *resolvers.HIP5Resolver) {
+	h, err := resolverstest.NewHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+
+	stub, err := resolver.NewStub(h.Recursive.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hip5 := resolvers.NewHIP5Resolver(stub, h.Root.Addr, func() bool {
+		return true
+	})
+	hip5.RegisterExtension(h.Extension())
+	h.Use(hip5)
+	return h, hip5
+}
+
+func newTestZone(t *testing.T, origin string, sign bool, records ...string) *resolverstest.Zone {
+	z, err := resolverstest.NewZone(origin, records...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sign {
+		if err := z.Sign(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return z
+}
+
+func assertA(t *testing.T, res *resolver.DNSResult, secure bool, want string) {
+	t.Helper()
+
+	if res.Err != nil {
+		t.Fatalf("got error %v", res.Err)
+	}
+
+	if res.Secure != secure {
+		t.Fatalf("got secure = %v, want %v", res.Secure, secure)
+	}
+
+	for _, rr := range res.Records {
+		if a, ok := rr.(*dns.A); ok && a.A.String() == want {
+			return
+		}
+	}
+
+	t.Fatalf("got records %v, want A %s", res.Records, want)
+}
+
+func TestHarnessStubFallback(t *testing.T) {
+	h, hip5 := newTestHarness(t)
+	h.AddRecursive(newTestZone(t, "example.", true, "www 300 IN A 192.0.2.1"))
+
+	res := hip5.Query(context.Background(), "www.example.", dns.TypeA)
+	assertA(t, res, true, "192.0.2.1")
+
+	// the second answer comes from the stub cache
+	for i := 0; i < 2; i++ {
+		ctx, info := resolvers.WithQueryInfo(context.Background())
+		if res := hip5.Query(ctx, "missing.example.", dns.TypeA); res.Err != nil || len(res.Records) != 0 {
+			t.Fatalf("got %v (err: %v), want no records", res.Records, res.Err)
+		}
+		if !info.NXDomain("missing.example.") {
+			t.Fatal("want nxdomain")
+		}
+		if _, ok := info.NegativeSOA("missing.example."); !ok {
+			t.Fatal("want negative soa")
+		}
+	}
+}
+
+func TestHarnessHIP5(t *testing.T) {
+	h, hip5 := newTestHarness(t)
+	h.AddRecursive(newTestZone(t, "example.", true, "www 300 IN A 192.0.2.1"))
+
+	z := newTestZone(t, "test.", true,
+		"www 300 IN A 192.0.2.2",
+		"alias 300 IN CNAME www",
+		"ext 300 IN CNAME www.example.",
+		"chain 300 IN CNAME alias",
+	)
+	if err := h.AddHIP5(z); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	assertA(t, hip5.Query(ctx, "www.test.", dns.TypeA), true, "192.0.2.2")
+	assertA(t, hip5.Query(ctx, "chain.test.", dns.TypeA), true, "192.0.2.2")
+	assertA(t, hip5.Query(ctx, "ext.test.", dns.TypeA), true, "192.0.2.1")
+
+	nxCtx, info := resolvers.WithQueryInfo(ctx)
+	if res := hip5.Query(nxCtx, "missing.test.", dns.TypeA); res.Err != nil || len(res.Records) != 0 {
+		t.Fatalf("got %v (err: %v), want no records", res.Records, res.Err)
+	}
+	if !info.NXDomain("missing.test.") {
+		t.Fatal("want nxdomain")
+	}
+
+	// sites without TLSA records still load
+	tlsa, secure, err := hip5.LookupTLSA(ctx, "443", "tcp", "missing.test.")
+	if err != nil || len(tlsa) != 0 || !secure {
+		t.Fatalf("got %v (secure: %v, err: %v), want secure empty answer", tlsa, secure, err)
+	}
+
+	res := hip5.Query(ctx, "www.test.", dns.TypeAAAA)
+	if res.Err != nil || len(res.Records) != 0 || !res.Secure {
+		t.Fatalf("got %v (secure: %v, err: %v), want secure nodata", res.Records, res.Secure, res.Err)
+	}
+}
+
+func TestHarnessHIP5Insecure(t *testing.T) {
+	h, hip5 := newTestHarness(t)
+	if err := h.AddHIP5(newTestZone(t, "test.", false, "www 300 IN A 192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	assertA(t, hip5.Query(context.Background(), "www.test.", dns.TypeA), false, "192.0.2.2")
+}
+
+func TestHarnessHIP5Bogus(t *testing.T) {
+	h, hip5 := newTestHarness(t)
+	z := newTestZone(t, "test.", true, "www 300 IN A 192.0.2.2")
+	if err := h.AddHIP5(z); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delegation still has the old DS
+	if err := z.Sign(); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := hip5.Query(context.Background(), "www.test.", dns.TypeA); res.Err == nil {
+		t.Fatalf("got records %v, want dnssec error", res.Records)
+	}
+}
@@ -0,0 +1,149 @@
+package resolverstest
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Server serves zones over UDP and TCP on a
+// random local port using the same port for both
+type Server struct {
+	Addr string
+	Port int
+
+	// names outside every zone get SERVFAIL instead
+	// of REFUSED and answers from signed zones have
+	// the AD bit set like the hnsd recursive resolver
+	Recursive bool
+
+	zones []*Zone
+	udp   *dns.Server
+	tcp   *dns.Server
+	sync.RWMutex
+}
+
+// NewServer starts an authoritative server for zones
+func NewServer(zones ...*Zone) (*Server, error) {
+	return newServer(false, zones)
+}
+
+// NewRecursiveServer starts a server answering
+// for zones like a recursive resolver
+func NewRecursiveServer(zones ...*Zone) (*Server, error) {
+	return newServer(true, zones)
+}
+
+func newServer(recursive bool, zones []*Zone) (*Server, error) {
+	s := &Server{Recursive: recursive, zones: zones}
+
+	var lastErr error
+	// the tcp port may be taken
+	for i := 0; i < 10; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+
+		s.Addr = pc.LocalAddr().String()
+		l, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			pc.Close()
+			lastErr = err
+			continue
+		}
+
+		_, port, _ := net.SplitHostPort(s.Addr)
+		s.Port, _ = strconv.Atoi(port)
+
+		s.udp = &dns.Server{PacketConn: pc, Handler: s}
+		s.tcp = &dns.Server{Listener: l, Handler: s}
+		s.start(s.udp)
+		s.start(s.tcp)
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("failed listening: %v", lastErr)
+}
+
+func (s *Server) start(srv *dns.Server) {
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() {
+		close(started)
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+}
+
+// AddZone serves z
+func (s *Server) AddZone(z *Zone) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.zones = append(s.zones, z)
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.udp.Shutdown()
+	s.tcp.Shutdown()
+}
+
+// zone returns the closest enclosing zone of name
+func (s *Server) zone(name string) *Zone {
+	s.RLock()
+	defer s.RUnlock()
+
+	var best *Zone
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z.Origin, name) &&
+			(best == nil || dns.CountLabel(z.Origin) > dns.CountLabel(best.Origin)) {
+			best = z
+		}
+	}
+
+	return best
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	var m *dns.Msg
+	z := s.zone(dns.CanonicalName(q.Name))
+	switch {
+	case z != nil:
+		m = z.answer(q, do)
+		if s.Recursive {
+			m.Authoritative = false
+			m.RecursionAvailable = true
+			m.AuthenticatedData = z.Signed()
+		}
+	case s.Recursive:
+		m = &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure, RecursionAvailable: true}}
+	default:
+		m = &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeRefused}}
+	}
+
+	rcode := m.Rcode
+	m.SetReply(r)
+	m.Rcode = rcode
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(4096, do)
+	}
+
+	w.WriteMsg(m)
+}
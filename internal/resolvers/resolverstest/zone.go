@@ -0,0 +1,370 @@
+package resolverstest
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSOA = "@ 300 IN SOA " + NSName + " hostmaster." + NSName + " 1 3600 600 86400 300"
+
+// Zone an authoritative zone served by a Server.
+// Records may be added until it's signed.
+type Zone struct {
+	Origin string
+
+	// records by owner and type
+	rrsets map[string]map[uint16][]dns.RR
+	sigs   map[string]map[uint16]dns.RR
+	nsec   map[string]*dns.NSEC
+	// nsec chain owner names in canonical order
+	chain []string
+
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	sync.RWMutex
+}
+
+// NewZone parses records in zone file format relative to origin.
+// A SOA record is added if records don't have one.
+func NewZone(origin string, records ...string) (*Zone, error) {
+	z := &Zone{
+		Origin: dns.CanonicalName(origin),
+		rrsets: make(map[string]map[uint16][]dns.RR),
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(strings.Join(records, "\n")), z.Origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if err := z.Add(rr); err != nil {
+			return nil, err
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed parsing zone %s: %v", z.Origin, err)
+	}
+
+	if _, ok := z.rrsets[z.Origin][dns.TypeSOA]; !ok {
+		soa, err := dns.NewRR("$ORIGIN " + z.Origin + "\n" + defaultSOA)
+		if err != nil {
+			return nil, err
+		}
+		z.Add(soa)
+	}
+
+	return z, nil
+}
+
+// Add adds rr to the zone
+func (z *Zone) Add(rr dns.RR) error {
+	z.Lock()
+	defer z.Unlock()
+
+	if z.key != nil {
+		return fmt.Errorf("zone %s is already signed", z.Origin)
+	}
+
+	name := dns.CanonicalName(rr.Header().Name)
+	if !dns.IsSubDomain(z.Origin, name) {
+		return fmt.Errorf("%s is out of zone %s", name, z.Origin)
+	}
+
+	rr.Header().Name = name
+	if z.rrsets[name] == nil {
+		z.rrsets[name] = make(map[uint16][]dns.RR)
+	}
+	z.rrsets[name][rr.Header().Rrtype] = append(z.rrsets[name][rr.Header().Rrtype], rr)
+	return nil
+}
+
+// Sign generates a key signing every authoritative record
+// set and adds NSEC records. Signing again rolls the key
+// so the DS record of a delegation no longer matches.
+func (z *Zone) Sign() error {
+	z.Lock()
+	defer z.Unlock()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: z.Origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	if err != nil {
+		return err
+	}
+
+	z.key, z.signer = key, priv.(crypto.Signer)
+	z.rrsets[z.Origin][dns.TypeDNSKEY] = []dns.RR{key}
+	z.buildChain()
+
+	z.sigs = make(map[string]map[uint16]dns.RR)
+	for name, sets := range z.rrsets {
+		if z.isGlue(name) {
+			continue
+		}
+
+		for t, rrs := range sets {
+			// delegation NS records aren't signed
+			if t == dns.TypeNS && name != z.Origin {
+				continue
+			}
+
+			if err := z.sign(name, t, rrs); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, nsec := range z.nsec {
+		if err := z.sign(name, dns.TypeNSEC, []dns.RR{nsec}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (z *Zone) sign(name string, t uint16, rrs []dns.RR) error {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.Origin,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(24 * time.Hour).Unix()),
+	}
+
+	if err := sig.Sign(z.signer, rrs); err != nil {
+		return fmt.Errorf("failed signing %s/%s: %v", name, dns.TypeToString[t], err)
+	}
+
+	if z.sigs[name] == nil {
+		z.sigs[name] = make(map[uint16]dns.RR)
+	}
+	z.sigs[name][t] = sig
+	return nil
+}
+
+// DS returns the DS record of the zone key or nil if not signed
+func (z *Zone) DS() []dns.RR {
+	z.RLock()
+	defer z.RUnlock()
+
+	if z.key == nil {
+		return nil
+	}
+
+	return []dns.RR{z.key.ToDS(dns.SHA256)}
+}
+
+// Signed reports whether the zone is signed
+func (z *Zone) Signed() bool {
+	z.RLock()
+	defer z.RUnlock()
+
+	return z.key != nil
+}
+
+// cut returns the closest delegation at or above
+// name but below the zone apex if any
+func (z *Zone) cut(name string) string {
+	labels := dns.SplitDomainName(name)
+	originLabels := dns.CountLabel(z.Origin)
+
+	for i := len(labels) - originLabels - 1; i >= 0; i-- {
+		ancestor := dns.Fqdn(strings.Join(labels[i:], "."))
+		if _, ok := z.rrsets[ancestor][dns.TypeNS]; ok {
+			return ancestor
+		}
+	}
+
+	return ""
+}
+
+// isGlue reports if name is below a delegation
+func (z *Zone) isGlue(name string) bool {
+	cut := z.cut(name)
+	return cut != "" && cut != name
+}
+
+func (z *Zone) buildChain() {
+	z.chain = z.chain[:0]
+	for name := range z.rrsets {
+		if !z.isGlue(name) {
+			z.chain = append(z.chain, name)
+		}
+	}
+
+	sort.Slice(z.chain, func(i, j int) bool {
+		return canonicalLess(z.chain[i], z.chain[j])
+	})
+
+	z.nsec = make(map[string]*dns.NSEC)
+	for i, name := range z.chain {
+		next := z.chain[(i+1)%len(z.chain)]
+		types := []uint16{dns.TypeNSEC, dns.TypeRRSIG}
+		for t := range z.rrsets[name] {
+			types = append(types, t)
+		}
+		sort.Slice(types, func(i, j int) bool {
+			return types[i] < types[j]
+		})
+
+		z.nsec[name] = &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next,
+			TypeBitMap: types,
+		}
+	}
+}
+
+// canonicalLess compares names in RFC 4034 6.1 order
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+
+	return len(la) < len(lb)
+}
+
+// covering returns the NSEC record covering name
+func (z *Zone) covering(name string) *dns.NSEC {
+	i := sort.Search(len(z.chain), func(i int) bool {
+		return canonicalLess(name, z.chain[i])
+	})
+
+	// the last name before name or the
+	// last one in the chain wraps around
+	if i == 0 {
+		i = len(z.chain)
+	}
+	return z.nsec[z.chain[i-1]]
+}
+
+// exists reports if name owns records or is an empty non-terminal
+func (z *Zone) exists(name string) bool {
+	if _, ok := z.rrsets[name]; ok {
+		return true
+	}
+
+	for owner := range z.rrsets {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withSigs appends signatures of rrs if dnssec is requested
+func (z *Zone) withSigs(do bool, rrs []dns.RR) []dns.RR {
+	if !do || z.key == nil || len(rrs) == 0 {
+		return rrs
+	}
+
+	name := rrs[0].Header().Name
+	if sig, ok := z.sigs[name][rrs[0].Header().Rrtype]; ok {
+		return append(append([]dns.RR(nil), rrs...), sig)
+	}
+
+	return rrs
+}
+
+// denial returns the SOA and NSEC records proving name
+// has no records of the requested type or doesn't exist
+func (z *Zone) denial(do bool, name string, nx bool) []dns.RR {
+	ns := z.withSigs(do, z.rrsets[z.Origin][dns.TypeSOA])
+	if !do || z.key == nil {
+		return ns
+	}
+
+	seen := make(map[string]bool)
+	add := func(nsec *dns.NSEC) {
+		if nsec == nil || seen[nsec.Hdr.Name] {
+			return
+		}
+
+		seen[nsec.Hdr.Name] = true
+		ns = append(ns, z.withSigs(do, []dns.RR{nsec})...)
+	}
+
+	if nsec, ok := z.nsec[name]; ok {
+		add(nsec)
+		return ns
+	}
+
+	add(z.covering(name))
+	if nx {
+		// prove there's no wildcard at the closest encloser
+		encloser := name
+		for encloser != z.Origin && !z.exists(encloser) {
+			off, _ := dns.NextLabel(encloser, 0)
+			encloser = encloser[off:]
+		}
+		add(z.covering("*." + encloser))
+	}
+
+	return ns
+}
+
+// answer returns the authoritative response to q
+func (z *Zone) answer(q dns.Question, do bool) *dns.Msg {
+	z.RLock()
+	defer z.RUnlock()
+
+	m := new(dns.Msg)
+	name := dns.CanonicalName(q.Name)
+
+	// referral unless asking the parent for the DS
+	if cut := z.cut(name); cut != "" && (cut != name || q.Qtype != dns.TypeDS) {
+		ns := z.rrsets[cut][dns.TypeNS]
+		m.Ns = append(m.Ns, ns...)
+		if ds, ok := z.rrsets[cut][dns.TypeDS]; ok {
+			m.Ns = append(m.Ns, z.withSigs(do, ds)...)
+		} else if do && z.key != nil {
+			m.Ns = append(m.Ns, z.withSigs(do, []dns.RR{z.nsec[cut]})...)
+		}
+
+		for _, rr := range ns {
+			target := dns.CanonicalName(rr.(*dns.NS).Ns)
+			m.Extra = append(m.Extra, z.rrsets[target][dns.TypeA]...)
+			m.Extra = append(m.Extra, z.rrsets[target][dns.TypeAAAA]...)
+		}
+		return m
+	}
+
+	m.Authoritative = true
+	if sets, ok := z.rrsets[name]; ok {
+		if rrs, ok := sets[q.Qtype]; ok {
+			m.Answer = z.withSigs(do, rrs)
+			return m
+		}
+
+		if cname, ok := sets[dns.TypeCNAME]; ok {
+			m.Answer = z.withSigs(do, cname)
+			return m
+		}
+
+		m.Ns = z.denial(do, name, false)
+		return m
+	}
+
+	if z.exists(name) {
+		m.Ns = z.denial(do, name, false)
+		return m
+	}
+
+	m.Rcode = dns.RcodeNameError
+	m.Ns = z.denial(do, name, true)
+	return m
+}
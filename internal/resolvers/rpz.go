@@ -0,0 +1,514 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often policy zone files are checked for changes
+const policyCheckInterval = time.Second
+
+// policyDepthKey counts local data CNAMEs
+// followed while resolving a query
+type policyDepthKey struct{}
+
+type policyAction int
+
+// RPZ actions (draft-vixie-dnsop-dns-rpz)
+const (
+	policyNXDomain policyAction = iota
+	policyNoData
+	policyPassthru
+	policyLocalData
+	policyActions
+)
+
+var policyActionNames = [policyActions]string{"nxdomain", "nodata", "passthru", "local-data"}
+
+func (a policyAction) String() string {
+	return policyActionNames[a]
+}
+
+type policyRule struct {
+	action policyAction
+	// local data with owner names
+	// relative to the trigger
+	rrs []dns.RR
+}
+
+type policyIPRule struct {
+	prefix *net.IPNet
+	rule   *policyRule
+}
+
+// RPZStats counters of a single policy zone
+type RPZStats struct {
+	Rules     int    `json:"rules"`
+	NXDomain  uint64 `json:"nxdomain"`
+	NoData    uint64 `json:"nodata"`
+	Passthru  uint64 `json:"passthru"`
+	LocalData uint64 `json:"localData"`
+	Error     string `json:"error,omitempty"`
+}
+
+type policyZone struct {
+	path   string
+	origin string
+
+	// qname triggers including
+	// wildcards as *.name.
+	names map[string]*policyRule
+	ips   []policyIPRule
+
+	modTime time.Time
+	err     error
+	hits    [policyActions]uint64
+}
+
+// PolicyZones applies Response Policy Zones loaded from files.
+// Zones are checked in order and the first one with
+// a matching trigger decides the action.
+type PolicyZones struct {
+	zones   []*policyZone
+	checked time.Time
+	sync.RWMutex
+}
+
+// policyMatch a rule that matched a query
+type policyMatch struct {
+	zone    *policyZone
+	rule    *policyRule
+	trigger string
+}
+
+// NewPolicyZones returns policy zones read from paths.
+// Nothing is loaded until Reload is called.
+func NewPolicyZones(paths []string) *PolicyZones {
+	p := &PolicyZones{}
+	for _, path := range paths {
+		p.zones = append(p.zones, &policyZone{
+			path:  path,
+			names: make(map[string]*policyRule),
+		})
+	}
+
+	return p
+}
+
+// Reload reads all policy zone files again. Zones
+// that fail to load keep their previous rules.
+func (p *PolicyZones) Reload() error {
+	return p.reload(true)
+}
+
+func (p *PolicyZones) reload(force bool) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.checked = time.Now()
+
+	var errs []string
+	for _, z := range p.zones {
+		if err := z.load(force); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (p *PolicyZones) maybeReload() {
+	p.RLock()
+	due := time.Since(p.checked) > policyCheckInterval
+	p.RUnlock()
+
+	if !due {
+		return
+	}
+
+	if err := p.reload(false); err != nil {
+		log.Printf("[WARN] rpz: %v", err)
+	}
+}
+
+// Stats returns counters for each zone by file name
+func (p *PolicyZones) Stats() map[string]RPZStats {
+	p.RLock()
+	defer p.RUnlock()
+
+	stats := make(map[string]RPZStats)
+	for _, z := range p.zones {
+		s := RPZStats{
+			Rules:     len(z.names) + len(z.ips),
+			NXDomain:  atomic.LoadUint64(&z.hits[policyNXDomain]),
+			NoData:    atomic.LoadUint64(&z.hits[policyNoData]),
+			Passthru:  atomic.LoadUint64(&z.hits[policyPassthru]),
+			LocalData: atomic.LoadUint64(&z.hits[policyLocalData]),
+		}
+		if z.err != nil {
+			s.Error = z.err.Error()
+		}
+
+		stats[filepath.Base(z.path)] = s
+	}
+
+	return stats
+}
+
+// load parses the zone file if it changed or force is set
+func (z *policyZone) load(force bool) error {
+	info, err := os.Stat(z.path)
+	if err != nil {
+		z.err = fmt.Errorf("failed reading policy zone: %v", err)
+		return z.err
+	}
+
+	if !force && info.ModTime().Equal(z.modTime) {
+		return nil
+	}
+
+	// errors are only reported once per change
+	z.modTime = info.ModTime()
+
+	data, err := ioutil.ReadFile(z.path)
+	if err != nil {
+		z.err = fmt.Errorf("failed reading policy zone: %v", err)
+		return z.err
+	}
+
+	origin, names, ips, err := parsePolicyZone(string(data), z.path)
+	if err != nil {
+		z.err = err
+		return err
+	}
+
+	z.origin, z.names, z.ips, z.err = origin, names, ips, nil
+	return nil
+}
+
+// parsePolicyZone reads RPZ rules from a zone file. The zone
+// name is taken from its SOA record. Triggers other than
+// QNAME and response IP are ignored.
+func parsePolicyZone(data, path string) (string, map[string]*policyRule, []policyIPRule, error) {
+	zp := dns.NewZoneParser(strings.NewReader(data), dns.Fqdn(filepath.Base(path)), path)
+	zp.SetDefaultTTL(localZoneDefaultTTL)
+
+	origin := ""
+	owners := make(map[string][]dns.RR)
+	var order []string
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if origin == "" {
+				origin = name
+			}
+			continue
+		}
+
+		if _, ok := owners[name]; !ok {
+			order = append(order, name)
+		}
+		owners[name] = append(owners[name], rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return "", nil, nil, fmt.Errorf("failed parsing policy zone %s: %v", path, err)
+	}
+
+	if origin == "" {
+		return "", nil, nil, fmt.Errorf("failed parsing policy zone %s: missing SOA record", path)
+	}
+
+	names := make(map[string]*policyRule)
+	var ips []policyIPRule
+	for _, owner := range order {
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue
+		}
+
+		rule, err := newPolicyRule(owners[owner])
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed parsing policy zone %s: %s: %v", path, owner, err)
+		}
+		if rule == nil {
+			continue
+		}
+
+		trigger := strings.TrimSuffix(owner, origin)
+		if strings.HasSuffix(trigger, ".rpz-ip.") {
+			prefix, err := parsePolicyIP(strings.TrimSuffix(trigger, ".rpz-ip."))
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("failed parsing policy zone %s: %s: %v", path, owner, err)
+			}
+
+			ips = append(ips, policyIPRule{prefix: prefix, rule: rule})
+			continue
+		}
+
+		// nsdname, nsip and client-ip
+		// triggers aren't supported
+		if labels := dns.SplitDomainName(trigger); strings.HasPrefix(labels[len(labels)-1], "rpz-") {
+			continue
+		}
+
+		names[trigger] = rule
+	}
+
+	return origin, names, ips, nil
+}
+
+// newPolicyRule returns the rule for the records of a trigger
+// or nil if it uses an action that isn't supported
+func newPolicyRule(rrs []dns.RR) (*policyRule, error) {
+	for _, rr := range rrs {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+
+		if len(rrs) > 1 {
+			return nil, errors.New("CNAME and other data")
+		}
+
+		switch target := dns.CanonicalName(cname.Target); target {
+		case ".", "rpz-drop.":
+			// queries can't be dropped
+			// answer with nxdomain instead
+			return &policyRule{action: policyNXDomain}, nil
+		case "*.":
+			return &policyRule{action: policyNoData}, nil
+		case "rpz-passthru.":
+			return &policyRule{action: policyPassthru}, nil
+		default:
+			if strings.HasPrefix(target, "rpz-") {
+				return nil, nil
+			}
+		}
+	}
+
+	return &policyRule{action: policyLocalData, rrs: rrs}, nil
+}
+
+// parsePolicyIP parses a reversed rpz-ip trigger such as
+// 24.0.2.0.192 or 128.1.zz.db8.2001 into a prefix
+func parsePolicyIP(trigger string) (*net.IPNet, error) {
+	labels := dns.SplitDomainName(trigger)
+	if len(labels) < 2 {
+		return nil, errors.New("bad rpz-ip trigger")
+	}
+
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, errors.New("bad rpz-ip prefix length")
+	}
+
+	addr := labels[1:]
+	for i, j := 0, len(addr)-1; i < j; i, j = i+1, j-1 {
+		addr[i], addr[j] = addr[j], addr[i]
+	}
+
+	var ip net.IP
+	size := 32
+	if len(addr) == 4 && bits <= 32 {
+		ip = net.ParseIP(strings.Join(addr, ".")).To4()
+	} else {
+		joined := strings.Join(addr, ":")
+		if strings.Contains(joined, "zz") {
+			joined = strings.Replace(joined, "zz", "", 1)
+			if strings.HasPrefix(joined, ":") {
+				joined = ":" + joined
+			}
+			if strings.HasSuffix(joined, ":") {
+				joined += ":"
+			}
+		}
+		ip = net.ParseIP(joined)
+		size = 128
+	}
+
+	if ip == nil || bits < 0 || bits > size {
+		return nil, errors.New("bad rpz-ip trigger")
+	}
+
+	mask := net.CIDRMask(bits, size)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// matchName returns the first rule for name. An exact
+// match in a zone is used before the closest wildcard.
+func (p *PolicyZones) matchName(name string) (policyMatch, bool) {
+	p.maybeReload()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	name = dns.CanonicalName(name)
+	for _, z := range p.zones {
+		if rule, ok := z.names[name]; ok {
+			return policyMatch{zone: z, rule: rule, trigger: name}, true
+		}
+
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			if rule, ok := z.names["*."+name[off:]]; ok {
+				return policyMatch{zone: z, rule: rule, trigger: "*." + name[off:]}, true
+			}
+		}
+	}
+
+	return policyMatch{}, false
+}
+
+// matchIPs returns the first rule for any address in rrs
+// using the longest matching prefix in a zone
+func (p *PolicyZones) matchIPs(rrs []dns.RR) (policyMatch, bool) {
+	var ips []net.IP
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *dns.A:
+			ips = append(ips, r.A)
+		case *dns.AAAA:
+			ips = append(ips, r.AAAA)
+		}
+	}
+
+	if len(ips) == 0 {
+		return policyMatch{}, false
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, z := range p.zones {
+		var best *policyIPRule
+		bestBits := -1
+		for i, r := range z.ips {
+			bits, _ := r.prefix.Mask.Size()
+			if bits <= bestBits {
+				continue
+			}
+
+			for _, ip := range ips {
+				if r.prefix.Contains(ip) {
+					best, bestBits = &z.ips[i], bits
+					break
+				}
+			}
+		}
+
+		if best != nil {
+			return policyMatch{zone: z, rule: best.rule, trigger: best.prefix.String()}, true
+		}
+	}
+
+	return policyMatch{}, false
+}
+
+// SetPolicyZones applies p to every query
+func (h *HIP5Resolver) SetPolicyZones(p *PolicyZones) {
+	h.policies = p
+}
+
+// applyPolicy returns the answer for a matched rule
+// or nil to continue with the original answer
+func (h *HIP5Resolver) applyPolicy(ctx context.Context, m policyMatch, name string, qtype uint16) *resolver.DNSResult {
+	atomic.AddUint64(&m.zone.hits[m.rule.action], 1)
+	traceStep(ctx, TraceStep{Kind: tracePolicy, Name: name, qtype: qtype,
+		Detail: fmt.Sprintf("%s %s in %s", m.rule.action, m.trigger, filepath.Base(m.zone.path))})
+
+	switch m.rule.action {
+	case policyPassthru:
+		return nil
+	case policyNXDomain:
+		markNegative(ctx, name, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}})
+		return &resolver.DNSResult{}
+	case policyNoData:
+		return &resolver.DNSResult{}
+	}
+
+	name = dns.Fqdn(name)
+	var rrs []dns.RR
+	var target string
+	for _, rr := range m.rule.rrs {
+		if rr.Header().Rrtype != qtype && rr.Header().Rrtype != dns.TypeCNAME {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+			// *.example. rewrites to name.example.
+			if strings.HasPrefix(cname.Target, "*.") {
+				cname.Target = name + cname.Target[2:]
+			}
+			target = cname.Target
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	res := &resolver.DNSResult{Records: rrs}
+	if target == "" {
+		return res
+	}
+
+	// targets may match rules again
+	depth, _ := ctx.Value(policyDepthKey{}).(int)
+	if depth > 10 {
+		return &resolver.DNSResult{Err: fmt.Errorf("policy rewrite failed: %w", errMaxDepthReached)}
+	}
+
+	targetRes := h.query(context.WithValue(ctx, policyDepthKey{}, depth+1), target, qtype)
+	if targetRes.Err != nil {
+		return targetRes
+	}
+
+	res.Records = append(res.Records, targetRes.Records...)
+	return res
+}
+
+// queryPolicy resolves name applying qname
+// and response ip triggers
+func (h *HIP5Resolver) queryPolicy(ctx context.Context, name string, qtype uint16, next func() *resolver.DNSResult) *resolver.DNSResult {
+	if h.policies == nil {
+		return next()
+	}
+
+	if m, ok := h.policies.matchName(name); ok {
+		if res := h.applyPolicy(ctx, m, name, qtype); res != nil {
+			return res
+		}
+
+		// passthru skips ip triggers
+		return next()
+	}
+
+	res := next()
+	if res.Err != nil {
+		return res
+	}
+
+	if m, ok := h.policies.matchIPs(res.Records); ok {
+		if policyRes := h.applyPolicy(ctx, m, name, qtype); policyRes != nil {
+			return policyRes
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,190 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicyZone = `
+$TTL 300
+@                       IN SOA  localhost. root.localhost. 1 3600 600 86400 60
+                        IN NS   localhost.
+phishing                IN CNAME .
+*.phishing              IN CNAME .
+empty                   IN CNAME *.
+good.phishing           IN CNAME rpz-passthru.
+redirect                IN A    127.0.0.9
+redirect                IN TXT  "blocked"
+alias                   IN CNAME example.
+32.1.0.0.10.rpz-ip      IN CNAME .
+24.0.0.0.10.rpz-ip      IN CNAME *.
+128.1.zz.db8.2001.rpz-ip IN CNAME .
+ns.rpz-nsdname          IN CNAME .
+`
+
+func TestParsePolicyIP(t *testing.T) {
+	tests := []struct {
+		trigger string
+		prefix  string
+	}{
+		{"32.1.0.0.10", "10.0.0.1/32"},
+		{"24.0.2.0.192", "192.0.2.0/24"},
+		{"128.1.zz.db8.2001", "2001:db8::1/128"},
+		{"48.zz.db8.2001", "2001:db8::/48"},
+		{"128.1.zz", "::1/128"},
+	}
+
+	for _, test := range tests {
+		got, err := parsePolicyIP(test.trigger)
+		if err != nil {
+			t.Fatalf("%s: %v", test.trigger, err)
+		}
+
+		if got.String() != test.prefix {
+			t.Fatalf("%s: got prefix = %s, want %s", test.trigger, got, test.prefix)
+		}
+	}
+
+	for _, bad := range []string{"1", "33.1.0.0.10", "x.1.0.0.10", "24.0.0.300.10"} {
+		if _, err := parsePolicyIP(bad); err == nil {
+			t.Fatalf("%s: want error", bad)
+		}
+	}
+}
+
+func TestHIP5Policy(t *testing.T) {
+	h := testStubResolver(
+		"good.phishing. 300 IN A 10.0.0.1",
+		"bad-ip.example. 300 IN A 10.0.0.1",
+		"nodata-ip.example. 300 IN A 10.0.0.7",
+		"bad-ip6.example. 300 IN AAAA 2001:db8::1",
+		"example. 300 IN A 127.0.0.5",
+		"ns.rpz-nsdname.example. 300 IN A 127.0.0.6",
+	)
+
+	p := NewPolicyZones([]string{testFile(t, "test.rpz", testPolicyZone)})
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	h.SetPolicyZones(p)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		nx      bool
+		records []string
+	}{
+		{name: "phishing.", qtype: dns.TypeA, nx: true},
+		{name: "www.phishing.", qtype: dns.TypeA, nx: true},
+		{name: "good.phishing.", qtype: dns.TypeA, records: []string{"good.phishing.\t300\tIN\tA\t10.0.0.1"}},
+		{name: "empty.", qtype: dns.TypeA},
+		{name: "redirect.", qtype: dns.TypeA, records: []string{"redirect.\t300\tIN\tA\t127.0.0.9"}},
+		{name: "redirect.", qtype: dns.TypeAAAA},
+		{name: "alias.", qtype: dns.TypeA, records: []string{"alias.\t300\tIN\tCNAME\texample.", "example.\t300\tIN\tA\t127.0.0.5"}},
+		{name: "bad-ip.example.", qtype: dns.TypeA, nx: true},
+		{name: "nodata-ip.example.", qtype: dns.TypeA},
+		{name: "bad-ip6.example.", qtype: dns.TypeAAAA, nx: true},
+		{name: "example.", qtype: dns.TypeA, records: []string{"example.\t300\tIN\tA\t127.0.0.5"}},
+		// unsupported triggers are ignored
+		{name: "ns.rpz-nsdname.example.", qtype: dns.TypeA, records: []string{"ns.rpz-nsdname.example.\t300\tIN\tA\t127.0.0.6"}},
+	}
+
+	for _, test := range tests {
+		ctx, info := WithQueryInfo(context.Background())
+		res := h.query(ctx, test.name, test.qtype)
+		if res.Err != nil {
+			t.Fatalf("%s: %v", test.name, res.Err)
+		}
+
+		if info.NXDomain(test.name) != test.nx {
+			t.Fatalf("%s: got nxdomain = %v, want %v", test.name, info.NXDomain(test.name), test.nx)
+		}
+
+		if len(res.Records) != len(test.records) {
+			t.Fatalf("%s: got records = %v, want %v", test.name, res.Records, test.records)
+		}
+
+		for i, rr := range res.Records {
+			if rr.String() != test.records[i] {
+				t.Fatalf("%s: got record = %s, want %s", test.name, rr.String(), test.records[i])
+			}
+		}
+	}
+
+	stats := p.Stats()["test.rpz"]
+	want := RPZStats{Rules: 9, NXDomain: 4, NoData: 2, Passthru: 1, LocalData: 3}
+	if stats != want {
+		t.Fatalf("got stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestHIP5PolicyLoop(t *testing.T) {
+	h := testStubResolver("ip-loop.example. 300 IN A 10.0.0.2")
+
+	zone := `
+$TTL 300
+@                   IN SOA  localhost. root.localhost. 1 3600 600 86400 60
+                    IN NS   localhost.
+loop-a              IN CNAME loop-b.
+loop-b              IN CNAME loop-a.
+*.wild              IN CNAME *.wild.
+32.2.0.0.10.rpz-ip  IN CNAME ip-loop.example.
+`
+	p := NewPolicyZones([]string{testFile(t, "loop.rpz", zone)})
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	h.SetPolicyZones(p)
+
+	for _, name := range []string{"loop-a.", "www.wild.", "ip-loop.example."} {
+		res := h.query(context.Background(), name, dns.TypeA)
+		if !errors.Is(res.Err, errMaxDepthReached) {
+			t.Fatalf("%s: got err = %v, want %v", name, res.Err, errMaxDepthReached)
+		}
+	}
+}
+
+func TestPolicyZonesReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.rpz")
+	p := NewPolicyZones([]string{file})
+
+	// missing files are reported
+	if err := p.Reload(); err == nil {
+		t.Fatal("want error for missing zone")
+	}
+
+	if _, ok := p.matchName("phishing."); ok {
+		t.Fatal("want no match before the zone exists")
+	}
+
+	if err := ioutil.WriteFile(file, []byte(testPolicyZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.matchName("phishing."); !ok {
+		t.Fatal("want match after reload")
+	}
+
+	// bad zones keep the last good rules
+	if err := ioutil.WriteFile(file, []byte("phishing IN CNAME .\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Fatal("want error for zone without SOA")
+	}
+
+	if _, ok := p.matchName("phishing."); !ok {
+		t.Fatal("want last good rules")
+	}
+
+	if stats := p.Stats()["test.rpz"]; stats.Error == "" {
+		t.Fatal("want error in stats")
+	}
+}
@@ -0,0 +1,195 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+// QueryFunc resolves a single question
+type QueryFunc func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult
+
+// DNSServer answers plain DNS queries over UDP and TCP
+// using the same resolution path as the proxy
+type DNSServer struct {
+	addr  string
+	query QueryFunc
+
+	udp *dns.Server
+	tcp *dns.Server
+	sync.Mutex
+}
+
+const serverQueryTimeout = 10 * time.Second
+
+func NewDNSServer(addr string, query QueryFunc) *DNSServer {
+	return &DNSServer{
+		addr:  addr,
+		query: query,
+	}
+}
+
+// Start binds both listeners and serves
+// queries in the background
+func (s *DNSServer) Start() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.udp != nil {
+		return errors.New("dns server already started")
+	}
+
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.udp = &dns.Server{PacketConn: pc, Handler: s}
+	s.tcp = &dns.Server{Listener: l, Handler: s}
+
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() {
+			close(started)
+		}
+
+		go srv.ActivateAndServe()
+		<-started
+	}
+
+	return nil
+}
+
+func (s *DNSServer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.udp == nil {
+		return nil
+	}
+
+	s.udp.Shutdown()
+	s.tcp.Shutdown()
+	s.udp, s.tcp = nil, nil
+	return nil
+}
+
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverQueryTimeout)
+	defer cancel()
+
+	ctx, _ = WithQueryInfo(ctx)
+	m := reply(ctx, s.query, r)
+
+	// truncate udp responses that don't fit
+	// the client's advertised buffer size
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+
+	w.WriteMsg(m)
+}
+
+// reply builds a response to r by resolving its question
+// with query. The AD bit is only set for secure answers.
+func reply(ctx context.Context, query QueryFunc, r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(4096, opt.Do())
+	}
+
+	if r.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		return m
+	}
+
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
+
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+
+	res := query(ctx, q.Name, q.Qtype)
+	if res.Err != nil {
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	}
+
+	for _, rr := range res.Records {
+		m.Answer = append(m.Answer, dns.Copy(rr))
+	}
+
+	// nxdomain answers are empty results
+	if !hasType(res.Records, q.Qtype) {
+		var nxdomain bool
+		if m.Ns, nxdomain = negative(ctx, q.Name, res.Records); nxdomain {
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+
+	m.AuthenticatedData = res.Secure
+	return m
+}
+
+// hasType reports whether rrs has records of qtype
+func hasType(rrs []dns.RR, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negative returns the SOA record seen for the last name in
+// the CNAME chain of rrs starting at qname and whether it exists
+func negative(ctx context.Context, qname string, rrs []dns.RR) ([]dns.RR, bool) {
+	info := queryInfoFromContext(ctx)
+	if info == nil {
+		return nil, false
+	}
+
+	name := chainTarget(qname, rrs)
+	var soa []dns.RR
+	if rr, ok := info.NegativeSOA(name); ok {
+		soa = []dns.RR{dns.Copy(rr)}
+	}
+
+	return soa, info.NXDomain(name)
+}
+
+// chainTarget returns the last name in the
+// CNAME chain of rrs starting at qname
+func chainTarget(qname string, rrs []dns.RR) string {
+	name := dns.CanonicalName(qname)
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == name {
+			name = dns.CanonicalName(cname.Target)
+		}
+	}
+
+	return name
+}
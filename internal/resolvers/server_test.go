@@ -0,0 +1,122 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	results := map[string]*resolver.DNSResult{
+		"secure.example.": {
+			Records: []dns.RR{testRR("secure.example. 300 IN A 127.0.0.1")},
+			Secure:  true,
+		},
+		"insecure.example.": {
+			Records: []dns.RR{testRR("insecure.example. 300 IN A 127.0.0.1")},
+		},
+		"nx.example.": {},
+		"fail.example.": {
+			Err: resolver.ErrServFail,
+		},
+	}
+
+	query := func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+		if name == "nx.example." {
+			markNegative(ctx, name, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}})
+		}
+		return results[name]
+	}
+
+	tests := []struct {
+		name    string
+		rcode   int
+		ad      bool
+		answers int
+	}{
+		{name: "secure.example.", rcode: dns.RcodeSuccess, ad: true, answers: 1},
+		{name: "insecure.example.", rcode: dns.RcodeSuccess, ad: false, answers: 1},
+		{name: "nx.example.", rcode: dns.RcodeNameError},
+		{name: "fail.example.", rcode: dns.RcodeServerFailure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(test.name, dns.TypeA)
+
+			ctx, _ := WithQueryInfo(context.Background())
+			m := reply(ctx, query, req)
+			if m.Rcode != test.rcode {
+				t.Fatalf("got rcode = %d, want %d", m.Rcode, test.rcode)
+			}
+			if m.AuthenticatedData != test.ad {
+				t.Fatalf("got ad = %v, want %v", m.AuthenticatedData, test.ad)
+			}
+			if len(m.Answer) != test.answers {
+				t.Fatalf("got answers = %d, want %d", len(m.Answer), test.answers)
+			}
+		})
+	}
+}
+
+func TestReplyStubNegative(t *testing.T) {
+	soa := testRR("example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300")
+
+	// like the letsdane stub Verify only sees answers that weren't cached
+	cached := make(map[string]bool)
+	stub := &resolver.Stub{}
+	stub.DefaultResolver.Query = func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+		if cached[name] {
+			return &resolver.DNSResult{}
+		}
+		cached[name] = true
+
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		r.Response = true
+		r.Ns = []dns.RR{soa}
+		if name == "nx.example." {
+			r.Rcode = dns.RcodeNameError
+		}
+		if err := stub.Verify(r); err != nil {
+			return &resolver.DNSResult{Err: err}
+		}
+		return &resolver.DNSResult{Records: r.Answer}
+	}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{name: "nx.example.", rcode: dns.RcodeNameError},
+		{name: "nodata.example.", rcode: dns.RcodeSuccess},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(test.name, dns.TypeA)
+
+			// the second answer comes from the stub cache
+			for i := 0; i < 2; i++ {
+				ctx, _ := WithQueryInfo(context.Background())
+				m := reply(ctx, h.query, req)
+				if m.Rcode != test.rcode {
+					t.Fatalf("got rcode = %d, want %d", m.Rcode, test.rcode)
+				}
+				if len(m.Answer) != 0 {
+					t.Fatalf("got answers = %v, want none", m.Answer)
+				}
+				if len(m.Ns) != 1 || m.Ns[0].String() != soa.String() {
+					t.Fatalf("got authority = %v, want %v", m.Ns, soa)
+				}
+			}
+		})
+	}
+}
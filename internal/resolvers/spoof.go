@@ -0,0 +1,222 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// Off-path spoofing protection for queries to hip-5 nameservers
+// using 0x20 mixed case query names and DNS cookies (RFC7873).
+// Both are detected per server so those that don't support
+// them still work. When a response doesn't match what a server
+// is known to support the query is repeated over tcp which
+// can't be spoofed off-path to find out if the server changed.
+
+const (
+	case0x20Unknown = iota
+	case0x20Supported
+	case0x20Unsupported
+)
+
+const (
+	clientCookieLen = 8
+	// server cookies are 8 to 32 bytes
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+var (
+	errSpoofSuspected = errors.New("response failed spoofing checks")
+	errBadCookie      = errors.New("server rejected cookie")
+	errNeedsTCP       = errors.New("response needs confirmation over tcp")
+)
+
+// randomizeCase flips the case of random letters in name
+// https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00
+func randomizeCase(name string) string {
+	b := []byte(name)
+	rnd := make([]byte, len(b))
+	if _, err := rand.Read(rnd); err != nil {
+		return name
+	}
+
+	for i, c := range b {
+		if rnd[i]&1 == 0 {
+			continue
+		}
+
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+
+	return string(b)
+}
+
+// clientCookie derives the client cookie used for addr
+// so servers can't track us across addresses
+func (s *serverStats) clientCookie(addr string) string {
+	h := sha256.New()
+	h.Write(s.cookieSecret)
+	h.Write([]byte(addr))
+	return hex.EncodeToString(h.Sum(nil)[:clientCookieLen])
+}
+
+func (s *serverStats) setCase0x20(addr string, state int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.getOrCreate(addr).case0x20 = state
+}
+
+// setServerCookie stores the last server cookie
+// empty if the server doesn't support cookies
+func (s *serverStats) setServerCookie(addr string, cookie string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.getOrCreate(addr).serverCookie = cookie
+}
+
+func setCookie(m *dns.Msg, cookie string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+
+	opt.Option = append(options, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: cookie,
+	})
+}
+
+func responseCookie(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+
+	return ""
+}
+
+// exchangeHardened sends m to addr with spoofing checks
+func (h *HIP5Resolver) exchangeHardened(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := h.exchangeChecked(ctx, m, addr, false)
+	if errors.Is(err, errBadCookie) {
+		// server sent a fresh cookie
+		r, rtt, err = h.exchangeChecked(ctx, m, addr, false)
+	}
+
+	if errors.Is(err, errNeedsTCP) {
+		r, rtt, err = h.exchangeChecked(ctx, m, addr, true)
+	}
+
+	return r, rtt, err
+}
+
+// exchangeChecked sends a copy of m using the spoofing protections
+// addr supports. If tcp is set the response is trusted and used
+// to update what the server supports.
+func (h *HIP5Resolver) exchangeChecked(ctx context.Context, m *dns.Msg, addr string, tcp bool) (*dns.Msg, time.Duration, error) {
+	info := h.nsStats.info(addr)
+	q := m.Copy()
+	qname := q.Question[0].Name
+
+	if info.case0x20 != case0x20Unsupported {
+		q.Question[0].Name = randomizeCase(qname)
+	}
+	sent := q.Question[0].Name
+
+	client := h.nsStats.clientCookie(addr)
+	setCookie(q, client+info.serverCookie)
+
+	var r *dns.Msg
+	var rtt time.Duration
+	var err error
+	if tcp {
+		r, rtt, err = h.exchangeTCP(ctx, q, addr)
+	} else {
+		r, rtt, err = exchangeWithFallback(ctx, q, addr, h.exchange, h.exchangeTCP)
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	if len(r.Question) != 1 || !strings.EqualFold(r.Question[0].Name, sent) ||
+		r.Question[0].Qtype != q.Question[0].Qtype {
+		return nil, rtt, fmt.Errorf("%w: question mismatch", errSpoofSuspected)
+	}
+
+	cookie := responseCookie(r)
+	switch {
+	case cookie == "":
+		if info.serverCookie != "" && !tcp {
+			return nil, rtt, fmt.Errorf("%w: missing cookie", errNeedsTCP)
+		}
+		h.nsStats.setServerCookie(addr, "")
+	case len(cookie) < 2*(clientCookieLen+minServerCookieLen) ||
+		len(cookie) > 2*(clientCookieLen+maxServerCookieLen) ||
+		!strings.EqualFold(cookie[:2*clientCookieLen], client):
+		return nil, rtt, fmt.Errorf("%w: bad cookie", errSpoofSuspected)
+	default:
+		h.nsStats.setServerCookie(addr, cookie[2*clientCookieLen:])
+	}
+
+	if r.Rcode == dns.RcodeBadCookie {
+		return nil, rtt, errBadCookie
+	}
+
+	if sent != qname {
+		if r.Question[0].Name != sent {
+			if !tcp {
+				return nil, rtt, fmt.Errorf("%w: qname case changed", errNeedsTCP)
+			}
+			h.nsStats.setCase0x20(addr, case0x20Unsupported)
+		} else if info.case0x20 == case0x20Unknown {
+			h.nsStats.setCase0x20(addr, case0x20Supported)
+		}
+	}
+
+	restoreCase(r, sent, qname)
+	return r, rtt, nil
+}
+
+// restoreCase replaces the mixed case query name in r
+// since names may be compressed to point to the question
+func restoreCase(r *dns.Msg, sent, qname string) {
+	if sent == qname {
+		return
+	}
+
+	r.Question[0].Name = qname
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, qname) {
+				rr.Header().Name = qname
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.example.forever."
+	changed := false
+
+	for i := 0; i < 20; i++ {
+		got := randomizeCase(name)
+		if !strings.EqualFold(got, name) {
+			t.Fatalf("got name = %s, want same name as %s", got, name)
+		}
+
+		changed = changed || got != name
+	}
+
+	if !changed {
+		t.Fatal("want mixed case names")
+	}
+}
+
+func newSpoofTestResolver() *HIP5Resolver {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	return NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+}
+
+func testReply(m *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = []dns.RR{testRR(m.Question[0].Name + " 300 IN A 127.0.0.10")}
+	return r
+}
+
+func TestHIP5Exchange0x20(t *testing.T) {
+	h := newSpoofTestResolver()
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	addr := "127.0.0.1:53"
+
+	var mu sync.Mutex
+	var sent []string
+	lowercase := true
+
+	// server that doesn't preserve case
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		mu.Lock()
+		sent = append(sent, m.Question[0].Name)
+		mu.Unlock()
+
+		r := testReply(m)
+		if lowercase {
+			r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		}
+		return r, time.Millisecond, nil
+	}
+	h.exchangeTCP = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		return h.exchange(ctx, m, a)
+	}
+
+	for i := 0; i < 10; i++ {
+		msg, err := h.exchangeNS(context.Background(), ips, "www.example.forever.", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// callers see the original name
+		if msg.Question[0].Name != "www.example.forever." || msg.Answer[0].Header().Name != "www.example.forever." {
+			t.Fatalf("got msg = %v, want original case", msg)
+		}
+	}
+
+	if state := h.nsStats.info(addr).case0x20; state != case0x20Unsupported {
+		t.Fatalf("got case0x20 = %d, want unsupported", state)
+	}
+
+	mu.Lock()
+	if last := sent[len(sent)-1]; last != "www.example.forever." {
+		t.Fatalf("got last sent name = %s, want no mixed case", last)
+	}
+	mu.Unlock()
+
+	// compliant server
+	h = newSpoofTestResolver()
+	lowercase = false
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		r := testReply(m)
+		if lowercase {
+			r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		}
+		return r, time.Millisecond, nil
+	}
+
+	var tcpQueries int
+	h.exchangeTCP = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		tcpQueries++
+		return testReply(m), time.Millisecond, nil
+	}
+
+	if _, err := h.exchangeNS(context.Background(), ips, "www.example.forever.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := h.nsStats.info(addr).case0x20; state != case0x20Supported {
+		t.Fatalf("got case0x20 = %d, want supported", state)
+	}
+
+	// a forged udp response is ignored and
+	// the answer is confirmed over tcp
+	lowercase = true
+	for i := 0; i < 10; i++ {
+		if _, err := h.exchangeNS(context.Background(), ips, "www.example.forever.", dns.TypeA); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tcpQueries == 0 {
+		t.Fatal("want tcp queries")
+	}
+
+	if state := h.nsStats.info(addr).case0x20; state != case0x20Supported {
+		t.Fatalf("got case0x20 = %d, want supported", state)
+	}
+}
+
+func TestHIP5ExchangeCookies(t *testing.T) {
+	h := newSpoofTestResolver()
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	addr := "127.0.0.1:53"
+	serverCookie := "0102030405060708"
+
+	var sentCookies []string
+	forge, badCookie := false, false
+
+	h.exchange = func(ctx context.Context, m *dns.Msg, a string) (*dns.Msg, time.Duration, error) {
+		cookie := responseCookie(m)
+		sentCookies = append(sentCookies, cookie)
+
+		r := testReply(m)
+		r.SetEdns0(4096, true)
+
+		client := cookie[:2*clientCookieLen]
+		if forge {
+			client = "0000000000000000"
+		}
+
+		if badCookie && !strings.HasSuffix(cookie, "ffffffffffffffff") {
+			r.Rcode = dns.RcodeBadCookie
+			setCookie(r, client+"ffffffffffffffff")
+			return r, time.Millisecond, nil
+		}
+
+		setCookie(r, client+serverCookie)
+		return r, time.Millisecond, nil
+	}
+
+	if _, err := h.exchangeNS(context.Background(), ips, "example.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	// server cookie is learned and sent back
+	if _, err := h.exchangeNS(context.Background(), ips, "example.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	client := h.nsStats.clientCookie(addr)
+	if sentCookies[0] != client || sentCookies[1] != client+serverCookie {
+		t.Fatalf("got cookies = %v, want client cookie then with server cookie", sentCookies)
+	}
+
+	// wrong client cookie
+	forge = true
+	if _, err := h.exchangeNS(context.Background(), ips, "example.", dns.TypeA); !errors.Is(err, errSpoofSuspected) {
+		t.Fatalf("got err = %v, want %v", err, errSpoofSuspected)
+	}
+
+	// retried with the new server cookie
+	forge, badCookie = false, true
+	if _, err := h.exchangeNS(context.Background(), ips, "example.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := h.nsStats.info(addr); info.serverCookie != serverCookie {
+		t.Fatalf("got server cookie = %s, want %s", info.serverCookie, serverCookie)
+	}
+}
@@ -0,0 +1,128 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Serve-stale support
+// https://datatracker.ietf.org/doc/html/rfc8767
+
+const (
+	// ttl of records served from expired data
+	staleTTL            = 30
+	staleRefreshTimeout = 10 * time.Second
+	DefaultMaxStale     = 24 * time.Hour
+)
+
+type answerCacheData struct {
+	rrs    []dns.RR
+	secure bool
+}
+
+// serveStale returns data from c that may have expired and
+// refreshes it in the background at most once at a time per refreshKey
+func serveStale(ctx context.Context, c *cache, key string, refreshing *sync.Map, refreshKey string, refresh func(ctx context.Context)) (*entry, bool) {
+	e, ok := c.getStale(key)
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().Before(e.ttl) {
+		return e, true
+	}
+
+	markStale(ctx)
+
+	if _, loaded := refreshing.LoadOrStore(refreshKey, struct{}{}); !loaded {
+		go func() {
+			defer refreshing.Delete(refreshKey)
+
+			ctx, cancel := context.WithTimeout(context.Background(), staleRefreshTimeout)
+			defer cancel()
+			refresh(ctx)
+		}()
+	}
+
+	return e, true
+}
+
+// withTTL returns a copy of rrs with the specified ttl
+func withTTL(rrs []dns.RR, ttl uint32) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+		out[i].Header().Ttl = ttl
+	}
+
+	return out
+}
+
+func answerKey(name string, qtype uint16) string {
+	return dns.CanonicalName(name) + ";" + strconv.Itoa(int(qtype))
+}
+
+// SetServeStale allows returning expired hip-5 answers
+// up to maxStale if a fresh lookup fails
+func (h *HIP5Resolver) SetServeStale(maxStale time.Duration) {
+	h.maxStale = maxStale
+	h.answerCache.setMaxStale(maxStale)
+}
+
+func (h *HIP5Resolver) storeAnswer(name string, qtype uint16, rrs []dns.RR, secure bool) {
+	if h.maxStale == 0 || len(rrs) == 0 {
+		return
+	}
+
+	h.answerCache.set(answerKey(name, qtype), &entry{
+		msg: &answerCacheData{
+			rrs:    rrs,
+			secure: secure,
+		},
+		ttl: time.Now().Add(getTTL(rrs)),
+	})
+}
+
+// staleAnswer returns a previous answer for name if a fresh
+// lookup failed. Expired answers are served with a short TTL.
+func (h *HIP5Resolver) staleAnswer(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+	if h.maxStale == 0 {
+		return nil
+	}
+
+	key := answerKey(name, qtype)
+	e, ok := serveStale(ctx, h.answerCache, key, &h.refreshing, key, func(ctx context.Context) {
+		h.queryInternal(ctx, name, qtype, 0)
+	})
+	if !ok {
+		return nil
+	}
+
+	data := e.msg.(*answerCacheData)
+	rrs := data.rrs
+	if time.Now().After(e.ttl) {
+		rrs = withTTL(rrs, staleTTL)
+	}
+
+	return &resolver.DNSResult{
+		Records: rrs,
+		Secure:  data.secure,
+		Err:     nil,
+	}
+}
+
+// staleAfterError returns a previous answer
+// for name after a lookup failed with err
+func (h *HIP5Resolver) staleAfterError(ctx context.Context, name string, qtype uint16, err error) *resolver.DNSResult {
+	stale := h.staleAnswer(ctx, name, qtype)
+	if stale != nil {
+		traceStep(ctx, TraceStep{Kind: traceStale, Name: name, qtype: qtype, rrs: stale.Records, err: err,
+			Detail: "serving previous answer after failed lookup"})
+	}
+
+	return stale
+}
@@ -0,0 +1,75 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHIP5ServeStale(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.SetServeStale(time.Hour)
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS stale._example.")})
+
+	var calls, failing int32
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("endpoint rate limited")
+		}
+		return []dns.RR{testRR("www.forever. 300 IN A 127.0.0.1")}, nil
+	})
+
+	res := h.query(context.Background(), "www.forever.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// expire the stored answer
+	key := answerKey("www.forever.", dns.TypeA)
+	e, _ := h.answerCache.getStale(key)
+	h.answerCache.set(key, &entry{msg: e.msg, ttl: time.Now().Add(-time.Minute)})
+
+	atomic.StoreInt32(&failing, 1)
+	ctx, info := WithQueryInfo(context.Background())
+	res = h.query(ctx, "www.forever.", dns.TypeA)
+	if res.Err != nil {
+		t.Fatalf("got err = %v, want stale answer", res.Err)
+	}
+
+	if len(res.Records) != 1 || res.Records[0].Header().Ttl != staleTTL {
+		t.Fatalf("got records = %v, want one record with ttl %d", res.Records, staleTTL)
+	}
+
+	if !info.Stale() {
+		t.Fatal("want result marked stale")
+	}
+
+	// a background refresh is attempted
+	deadline := time.Now().Add(time.Second)
+	for _, refreshing := h.refreshing.Load(key); refreshing || atomic.LoadInt32(&calls) < 3; _, refreshing = h.refreshing.Load(key) {
+		if time.Now().After(deadline) {
+			t.Fatal("want background refresh")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// disabled serve-stale returns the error
+	h.SetServeStale(0)
+	if res = h.query(context.Background(), "www.forever.", dns.TypeA); res.Err == nil {
+		t.Fatal("want error with serve-stale disabled")
+	}
+}
@@ -0,0 +1,67 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"time"
+)
+
+const (
+	// max negative stub answers kept
+	stubNegativeCacheSize = 5000
+	// the letsdane stub caches answers for up to 3 hours
+	stubNegativeTTL = 3 * time.Hour
+)
+
+// verifyStub wraps the Verify hook of the letsdane stub to keep
+// the rcode and SOA of negative answers which the stub drops.
+// Verify only sees answers the stub didn't have cached so entries
+// are replaced whenever the stub refreshes its own.
+func (h *HIP5Resolver) verifyStub(verify func(m *dns.Msg) error) func(m *dns.Msg) error {
+	return func(m *dns.Msg) error {
+		if verify != nil {
+			if err := verify(m); err != nil {
+				return err
+			}
+		}
+
+		if len(m.Question) != 1 {
+			return nil
+		}
+
+		key := answerKey(m.Question[0].Name, m.Question[0].Qtype)
+		neg := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: m.Rcode}}
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				neg.Ns = []dns.RR{soa}
+				break
+			}
+		}
+
+		if neg.Rcode != dns.RcodeNameError && len(neg.Ns) == 0 {
+			h.stubNegCache.remove(key)
+			return nil
+		}
+
+		h.stubNegCache.set(key, &entry{
+			msg: neg,
+			ttl: time.Now().Add(stubNegativeTTL),
+		})
+		return nil
+	}
+}
+
+// markStubNegative passes the rcode and SOA of a negative
+// stub answer for name on to DNS clients
+func (h *HIP5Resolver) markStubNegative(ctx context.Context, name string, qtype uint16, rrs []dns.RR) {
+	if hasType(rrs, qtype) {
+		return
+	}
+
+	e, ok := h.stubNegCache.get(answerKey(name, qtype))
+	if !ok {
+		return
+	}
+
+	markNegative(ctx, chainTarget(name, rrs), e.msg.(*dns.Msg))
+}
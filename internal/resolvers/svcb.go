@@ -0,0 +1,125 @@
+package resolvers
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// SVCB and HTTPS records
+// https://datatracker.ietf.org/doc/html/draft-ietf-dnsop-svcb-https-07
+//
+// miekg/dns v1.1.31 doesn't support these types
+// they're kept as unknown RFC3597 records so they
+// pass through unchanged and decoded here when needed.
+
+const (
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+)
+
+var errBadSVCB = errors.New("bad svcb rdata")
+
+type svcParam struct {
+	key   uint16
+	value []byte
+}
+
+// svcb decoded rdata of SVCB and HTTPS records
+type svcb struct {
+	priority uint16
+	target   string
+	// sorted by key
+	params []svcParam
+}
+
+func isSVCBType(t uint16) bool {
+	return t == TypeSVCB || t == TypeHTTPS
+}
+
+// unpackSVCB decodes rr if it's an SVCB or HTTPS record
+func unpackSVCB(rr dns.RR) (*svcb, error) {
+	generic, ok := rr.(*dns.RFC3597)
+	if !ok || !isSVCBType(rr.Header().Rrtype) {
+		return nil, errBadSVCB
+	}
+
+	raw, err := hex.DecodeString(generic.Rdata)
+	if err != nil || len(raw) < 3 {
+		return nil, errBadSVCB
+	}
+
+	s := &svcb{priority: binary.BigEndian.Uint16(raw)}
+	off := 2
+	if s.target, off, err = dns.UnpackDomainName(raw, off); err != nil {
+		return nil, errBadSVCB
+	}
+
+	for off < len(raw) {
+		if off+4 > len(raw) {
+			return nil, errBadSVCB
+		}
+
+		key := binary.BigEndian.Uint16(raw[off:])
+		length := int(binary.BigEndian.Uint16(raw[off+2:]))
+		off += 4
+
+		if off+length > len(raw) {
+			return nil, errBadSVCB
+		}
+
+		// keys must be in strictly increasing order
+		if n := len(s.params); n > 0 && s.params[n-1].key >= key {
+			return nil, errBadSVCB
+		}
+
+		s.params = append(s.params, svcParam{key: key, value: raw[off : off+length]})
+		off += length
+	}
+
+	return s, nil
+}
+
+// aliasMode records redirect to another
+// name similar to a CNAME
+func (s *svcb) aliasMode() bool {
+	return s.priority == 0
+}
+
+// svcbAlias returns AliasMode records in rrs
+// owned by qname as links to follow
+func svcbAlias(rrs []dns.RR, qname string, qtype uint16) []chainLink {
+	var aliases []chainLink
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != qtype || !isSVCBType(qtype) ||
+			!strings.EqualFold(rr.Header().Name, qname) {
+			continue
+		}
+
+		s, err := unpackSVCB(rr)
+		if err != nil || !s.aliasMode() {
+			continue
+		}
+
+		aliases = append(aliases, chainLink{
+			target: dns.CanonicalName(s.target),
+			rrs:    []dns.RR{rr},
+		})
+	}
+
+	return aliases
+}
+
+func init() {
+	// allows using HTTPS/SVCB in zone files and queries
+	// unless the dns library supports them already
+	for name, t := range map[string]uint16{"SVCB": TypeSVCB, "HTTPS": TypeHTTPS} {
+		if _, ok := dns.StringToType[name]; !ok {
+			dns.StringToType[name] = t
+			dns.TypeToString[t] = name
+		}
+	}
+}
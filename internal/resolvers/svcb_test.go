@@ -0,0 +1,86 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestUnpackSVCB(t *testing.T) {
+	// alpn h2 and ipv4hint 127.0.0.1
+	rr := testRR(`example. 300 IN HTTPS \# 30 000103737663076578616d706c650000010003026832000400047f000001`)
+	got, err := unpackSVCB(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.priority != 1 || got.target != "svc.example." || len(got.params) != 2 {
+		t.Fatalf("got svcb = %+v, want priority 1 target svc.example. and 2 params", got)
+	}
+
+	if got.params[1].key != 4 || !net.IP(got.params[1].value).Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("got params = %v, want ipv4hint 127.0.0.1", got.params)
+	}
+
+	// keys must be sorted
+	bad := testRR(`example. 300 IN HTTPS \# 11 0001000003000000010000`)
+	if _, err := unpackSVCB(bad); err != errBadSVCB {
+		t.Fatalf("got err = %v, want %v", err, errBadSVCB)
+	}
+}
+
+func TestHIP5HTTPS(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS https._example.")})
+
+	// alpn h3
+	service := testRR(`svc.forever. 300 IN HTTPS \# 10 00010000010003026833`)
+	records := map[string]map[uint16][]dns.RR{
+		"www.forever.": {
+			TypeHTTPS: {testRR(`www.forever. 300 IN HTTPS \# 15 00000373766307666f726576657200`)},
+		},
+		"svc.forever.": {
+			TypeHTTPS: {service},
+			dns.TypeA: {testRR("svc.forever. 300 IN A 127.0.0.1")},
+		},
+		"gone.forever.": {
+			TypeHTTPS: {testRR(`gone.forever. 300 IN HTTPS \# 3 000000`)},
+		},
+	}
+
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		return records[qname][qtype], nil
+	})
+
+	res := h.query(context.Background(), "www.forever.", TypeHTTPS)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	// alias followed by the target
+	if len(res.Records) != 2 || res.Records[0].Header().Name != "www.forever." {
+		t.Fatalf("got records = %v, want 2", res.Records)
+	}
+
+	// service records are returned as published
+	if res.Records[1].String() != service.String() || !res.Secure {
+		t.Fatalf("got record = %v secure = %v, want %v", res.Records[1], res.Secure, service)
+	}
+
+	// alias to root means no service
+	res = h.query(context.Background(), "gone.forever.", TypeHTTPS)
+	if res.Err != nil || len(res.Records) != 1 {
+		t.Fatalf("got records = %v err = %v, want only the alias", res.Records, res.Err)
+	}
+}
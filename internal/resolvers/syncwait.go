@@ -0,0 +1,65 @@
+package resolvers
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultSyncWait      = 30 * time.Second
+	DefaultSyncWaitQueue = 100
+	syncWaitPollInterval = 250 * time.Millisecond
+)
+
+// SetSyncWait parks queries made while hnsd is syncing until it's
+// synced for up to timeout instead of failing immediately.
+// At most maxWaiting queries wait at a time others fail right away.
+// A zero timeout disables waiting.
+func (h *HIP5Resolver) SetSyncWait(timeout time.Duration, maxWaiting int) {
+	h.syncWait = timeout
+	h.syncWaitMax = int32(maxWaiting)
+}
+
+// SyncWaiting returns the number of queries waiting for sync
+func (h *HIP5Resolver) SyncWaiting() int {
+	return int(atomic.LoadInt32(&h.syncWaiting))
+}
+
+// waitForSync blocks until synced, the wait times out,
+// ctx is done or returns immediately if too many
+// queries are already waiting. It reports if synced.
+func (h *HIP5Resolver) waitForSync(ctx context.Context) bool {
+	if h.syncCheck() {
+		return true
+	}
+
+	if h.syncWait <= 0 {
+		return false
+	}
+
+	if n := atomic.AddInt32(&h.syncWaiting, 1); n > h.syncWaitMax {
+		atomic.AddInt32(&h.syncWaiting, -1)
+		return false
+	}
+	defer atomic.AddInt32(&h.syncWaiting, -1)
+
+	timeout := time.NewTimer(h.syncWait)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(syncWaitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if h.syncCheck() {
+				return true
+			}
+		case <-timeout.C:
+			return h.syncCheck()
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHIP5WaitForSync(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Records: []dns.RR{testRR(name + " 300 IN A 127.0.0.1")}}
+		},
+	}}
+
+	var synced int32
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return atomic.LoadInt32(&synced) == 1
+	})
+
+	// disabled by default
+	if res := h.query(context.Background(), "example.", dns.TypeA); !errors.Is(res.Err, errNotSynced) {
+		t.Fatalf("got err = %v, want %v", res.Err, errNotSynced)
+	}
+
+	h.SetSyncWait(2*time.Second, 1)
+
+	var wg sync.WaitGroup
+	var res *resolver.DNSResult
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res = h.query(context.Background(), "example.", dns.TypeA)
+	}()
+
+	// wait until parked
+	for h.SyncWaiting() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// queue is full
+	if res := h.query(context.Background(), "example.", dns.TypeA); !errors.Is(res.Err, errNotSynced) {
+		t.Fatalf("got err = %v, want %v", res.Err, errNotSynced)
+	}
+
+	atomic.StoreInt32(&synced, 1)
+	wg.Wait()
+
+	if res.Err != nil || len(res.Records) != 1 {
+		t.Fatalf("got records = %v err = %v, want answer once synced", res.Records, res.Err)
+	}
+
+	// gives up after the timeout
+	atomic.StoreInt32(&synced, 0)
+	h.SetSyncWait(100*time.Millisecond, 1)
+
+	start := time.Now()
+	if res := h.query(context.Background(), "example.", dns.TypeA); !errors.Is(res.Err, errNotSynced) {
+		t.Fatalf("got err = %v, want %v", res.Err, errNotSynced)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got elapsed = %v, want about 100ms", elapsed)
+	}
+}
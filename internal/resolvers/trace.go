@@ -0,0 +1,158 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// trace step kinds
+const (
+	traceStub      = "stub"
+	traceCache     = "cache"
+	traceRoot      = "root"
+	traceExtension = "extension"
+	traceNS        = "ns"
+	traceCNAME     = "cname"
+	traceDNSSEC    = "dnssec"
+	traceStale     = "stale"
+	traceLocal     = "local"
+	tracePolicy    = "policy"
+	traceForward   = "forward"
+	traceDoH       = "doh"
+)
+
+type traceKey struct{}
+
+// TraceStep a single hop of a lookup
+type TraceStep struct {
+	// time since the trace started
+	Elapsed time.Duration `json:"elapsed"`
+	Kind    string        `json:"kind"`
+	Name    string        `json:"name"`
+	Type    string        `json:"type"`
+	Server  string        `json:"server,omitempty"`
+	RTT     time.Duration `json:"rtt,omitempty"`
+	Rcode   string        `json:"rcode,omitempty"`
+	Records []string      `json:"records,omitempty"`
+	Detail  string        `json:"detail,omitempty"`
+	Error   string        `json:"error,omitempty"`
+
+	// converted when the step is added
+	// to avoid the cost if not tracing
+	qtype uint16
+	rrs   []dns.RR
+	err   error
+}
+
+// Trace records every step taken to resolve a name
+type Trace struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Steps    []TraceStep   `json:"steps"`
+	Records  []string      `json:"records"`
+	Secure   bool          `json:"secure"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+
+	start time.Time
+	// steps of lookups still running when
+	// the result is in are left out
+	finished bool
+	sync.Mutex
+}
+
+// WithTrace returns a context that records
+// the steps of queries resolved with it
+func WithTrace(ctx context.Context, name string, qtype uint16) (context.Context, *Trace) {
+	t := &Trace{
+		Name:  dns.Fqdn(name),
+		Type:  dns.TypeToString[qtype],
+		start: time.Now(),
+	}
+
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+func traceFromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// traceStep adds s to the trace in ctx if any
+func traceStep(ctx context.Context, s TraceStep) {
+	t := traceFromContext(ctx)
+	if t == nil {
+		return
+	}
+
+	if s.qtype != 0 {
+		s.Type = dns.TypeToString[s.qtype]
+	}
+	if len(s.rrs) > 0 {
+		s.Records = encodeRRs(s.rrs)
+	}
+	if s.err != nil {
+		s.Error = s.err.Error()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.finished {
+		return
+	}
+
+	s.Elapsed = time.Since(t.start)
+	t.Steps = append(t.Steps, s)
+}
+
+// finish records the final result
+func (t *Trace) finish(rrs []dns.RR, secure bool, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.Records = encodeRRs(rrs)
+	t.Secure = secure
+	if err != nil {
+		t.Error = err.Error()
+	}
+	t.Duration = time.Since(t.start)
+	t.finished = true
+}
+
+// Trace resolves name and returns every step taken.
+// Caches are used as usual and show up as cache steps.
+func (h *HIP5Resolver) Trace(ctx context.Context, name string, qtype uint16) *Trace {
+	ctx, t := WithTrace(ctx, name, qtype)
+
+	res := h.query(ctx, dns.Fqdn(name), qtype)
+	t.finish(res.Records, res.Secure, res.Err)
+	return t
+}
+
+func traceExchange(ctx context.Context, kind string, m *dns.Msg, server string, r *dns.Msg, rtt time.Duration, err error) {
+	if traceFromContext(ctx) == nil {
+		return
+	}
+
+	s := TraceStep{
+		Kind:   kind,
+		Name:   m.Question[0].Name,
+		qtype:  m.Question[0].Qtype,
+		Server: server,
+		RTT:    rtt,
+		err:    err,
+	}
+
+	if r != nil {
+		s.Rcode = dns.RcodeToString[r.Rcode]
+		s.rrs = r.Answer
+		if len(s.rrs) == 0 {
+			s.rrs = r.Ns
+		}
+	}
+
+	traceStep(ctx, s)
+}
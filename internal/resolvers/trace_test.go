@@ -0,0 +1,67 @@
+package resolvers
+
+import (
+	"context"
+	"github.com/buffrr/letsdane/resolver"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestHIP5Trace(t *testing.T) {
+	stub := &resolver.Stub{DefaultResolver: resolver.DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+			return &resolver.DNSResult{Err: resolver.ErrServFail}
+		},
+	}}
+
+	h := NewHIP5Resolver(stub, "0.0.0.0", func() bool {
+		return true
+	})
+	h.exchangeRoot = testExchangeRootFunc(t, "forever.",
+		[]dns.RR{testRR("forever. 300 IN NS trace._example.")})
+	h.RegisterHandler("_example", func(ctx context.Context, qname string, qtype uint16, ns *dns.NS) ([]dns.RR, error) {
+		return []dns.RR{testRR("www.forever. 300 IN A 127.0.0.1")}, nil
+	})
+
+	trace := h.Trace(context.Background(), "www.forever", dns.TypeA)
+	if trace.Error != "" {
+		t.Fatal(trace.Error)
+	}
+
+	var kinds []string
+	for _, s := range trace.Steps {
+		kinds = append(kinds, s.Kind)
+	}
+
+	want := []string{traceStub, traceRoot, traceExtension}
+	if len(kinds) != len(want) {
+		t.Fatalf("got steps = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("got steps = %v, want %v", kinds, want)
+		}
+	}
+
+	if len(trace.Records) != 1 {
+		t.Fatalf("got %d records, want 1", len(trace.Records))
+	}
+
+	// known delegation skips the stub on the second lookup
+	trace = h.Trace(context.Background(), "www.forever", dns.TypeA)
+	if len(trace.Steps) != 2 || trace.Steps[0].Kind != traceCache {
+		t.Fatalf("got steps = %+v, want tld cache hit", trace.Steps)
+	}
+}
+
+func TestTraceFinished(t *testing.T) {
+	ctx, trace := WithTrace(context.Background(), "example.", dns.TypeA)
+	traceStep(ctx, TraceStep{Kind: traceStub, Name: "example."})
+	trace.finish(nil, false, nil)
+
+	// late steps from losing lookups
+	traceStep(ctx, TraceStep{Kind: traceNS, Name: "example."})
+	if len(trace.Steps) != 1 {
+		t.Fatalf("got %d steps, want 1", len(trace.Steps))
+	}
+}
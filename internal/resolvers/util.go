@@ -5,6 +5,7 @@ package resolvers
 // https://github.com/wealdtech/go-ens/blob/904e0feb4c0df8478b11e9e475afde5852c87763/namehash.go
 
 import (
+	"fingertip/internal/resolvers/dnssec"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -167,6 +168,55 @@ func FirstNLabels(name string, n int) string {
 	return strings.Join(parts[:n], ".")
 }
 
+// substituteDNAME replaces the dname owner suffix of
+// qname with its target. qname must be below the owner
+// RFC6672 2.2
+func substituteDNAME(dname *dns.DNAME, qname string) (string, error) {
+	owner := dns.CanonicalName(dname.Header().Name)
+	prefix := FirstNLabels(qname, dns.CountLabel(qname)-dns.CountLabel(owner))
+
+	target := dns.CanonicalName(dname.Target)
+	if target != "." {
+		prefix += "."
+	}
+
+	name := prefix + target
+	if _, ok := dns.IsDomainName(name); !ok || len(name) > 255 {
+		return "", errBadDNAMETarget
+	}
+
+	return name, nil
+}
+
+// synthesizeCNAME returns a CNAME for qname from the first
+// DNAME in rrs redirecting one of its parents and the DNAME used
+func synthesizeCNAME(rrs []*dns.DNAME, qname string) (*dns.CNAME, *dns.DNAME, error) {
+	qname = dns.CanonicalName(qname)
+
+	for _, rr := range rrs {
+		if !dnssec.IsSubDomainStrict(dns.CanonicalName(rr.Header().Name), qname) {
+			continue
+		}
+
+		target, err := substituteDNAME(rr, qname)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    rr.Header().Ttl,
+			},
+			Target: target,
+		}, rr, nil
+	}
+
+	return nil, nil, nil
+}
+
 func nsToRR(ns []*dns.NS) (rrs []dns.RR) {
 	for _, rr := range ns {
 		rrs = append(rrs, rr)
@@ -197,3 +247,48 @@ func getTTL(rrs []dns.RR) time.Duration {
 
 	return time.Duration(ttl) * time.Second
 }
+
+const (
+	minNegativeTTL = time.Minute
+	maxNegativeTTL = 15 * time.Minute
+)
+
+// getNegativeTTL finds how long a response without
+// hip-5 records may be cached using the SOA
+// or the referral NS TTL
+// https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func getNegativeTTL(msg *dns.Msg) time.Duration {
+	var ttl uint32
+	found := false
+
+	for _, rr := range msg.Ns {
+		var v uint32
+		switch t := rr.(type) {
+		case *dns.SOA:
+			v = t.Hdr.Ttl
+			if t.Minttl < v {
+				v = t.Minttl
+			}
+		case *dns.NS:
+			v = t.Hdr.Ttl
+		default:
+			continue
+		}
+
+		if !found || v < ttl {
+			ttl = v
+			found = true
+		}
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d < minNegativeTTL {
+		return minNegativeTTL
+	}
+
+	if d > maxNegativeTTL {
+		return maxNegativeTTL
+	}
+
+	return d
+}
@@ -2,6 +2,7 @@ package resolvers
 
 import (
 	"github.com/miekg/dns"
+	"strings"
 	"testing"
 	"time"
 )
@@ -59,3 +60,71 @@ func Test_getTTL(t *testing.T) {
 		t.Fatalf("got ttl = %v, want %v", ttl, time.Minute)
 	}
 }
+
+func Test_getNegativeTTL(t *testing.T) {
+	soa := new(dns.Msg)
+	soa.Ns = []dns.RR{testRR(". 86400 IN SOA . . 1 1800 900 604800 300")}
+	if ttl := getNegativeTTL(soa); ttl != 300*time.Second {
+		t.Fatalf("got ttl = %v, want %v", ttl, 300*time.Second)
+	}
+
+	referral := new(dns.Msg)
+	referral.Ns = []dns.RR{
+		testRR("example. 21600 IN NS ns1.example."),
+		testRR("example. 600 IN NS ns2.example."),
+	}
+	if ttl := getNegativeTTL(referral); ttl != 600*time.Second {
+		t.Fatalf("got ttl = %v, want %v", ttl, 600*time.Second)
+	}
+
+	if ttl := getNegativeTTL(new(dns.Msg)); ttl != minNegativeTTL {
+		t.Fatalf("got ttl = %v, want %v", ttl, minNegativeTTL)
+	}
+}
+
+func Test_synthesizeCNAME(t *testing.T) {
+	dnames := []*dns.DNAME{
+		testRR("old.forever. 300 IN DNAME new.example.").(*dns.DNAME),
+		testRR("root.forever. 300 IN DNAME .").(*dns.DNAME),
+	}
+
+	tests := []struct {
+		qname  string
+		target string
+	}{
+		{"www.old.forever.", "www.new.example."},
+		{"A.B.Old.Forever.", "a.b.new.example."},
+		{"com.root.forever.", "com."},
+		// dname owner itself isn't redirected
+		{"old.forever.", ""},
+		{"other.forever.", ""},
+	}
+
+	for _, test := range tests {
+		cname, dname, err := synthesizeCNAME(dnames, test.qname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.target == "" {
+			if cname != nil {
+				t.Fatalf("got cname = %v for %s, want none", cname, test.qname)
+			}
+			continue
+		}
+
+		if cname == nil || cname.Target != test.target || cname.Hdr.Ttl != 300 {
+			t.Fatalf("got cname = %v for %s, want target %s", cname, test.qname, test.target)
+		}
+
+		if !dns.IsSubDomain(dname.Hdr.Name, test.qname) {
+			t.Fatalf("got dname = %v for %s", dname, test.qname)
+		}
+	}
+
+	long := strings.Repeat("a", 63)
+	dname := testRR("x. 300 IN DNAME " + strings.Repeat(long+".", 3)).(*dns.DNAME)
+	if _, _, err := synthesizeCNAME([]*dns.DNAME{dname}, long+".x."); err != errBadDNAMETarget {
+		t.Fatalf("got err = %v, want %v", err, errBadDNAMETarget)
+	}
+}
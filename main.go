@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fingertip/internal/config"
 	"fingertip/internal/config/auto"
@@ -17,19 +18,39 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 const Version = "0.0.3"
 
+const (
+	hip5CacheFileName = "hip5.cache"
+	ensCacheFileName  = "ens.cache"
+	localZoneFileName = "local.zone"
+)
+
 type App struct {
 	proc             *proc.HNSProc
 	server           *http.Server
+	dnsServer        *resolvers.DNSServer
+	resolver         *resolvers.HIP5Resolver
+	ethereum         *resolvers.Ethereum
+	doh              *resolvers.DoHExtension
 	config           *config.App
 	usrConfig        *config.User
 	proxyURL         string
 	autostart        *autostart.App
 	autostartEnabled bool
+
+	// guards the resolvers which
+	// are replaced on stop
+	mu sync.Mutex
+
+	// reports whether hnsd is synced
+	// uses proc if nil, needed for tests
+	syncCheck func() bool
 }
 
 var (
@@ -248,6 +269,9 @@ func main() {
 				app.proc.Stop()
 				app.proc.Start(hnsErrCh)
 
+				// root zone data may have changed
+				app.clearNegativeCache()
+
 			case <-ticker.C:
 				if !app.proc.Started() {
 					ui.Data.SetBlockHeight("--")
@@ -332,33 +356,164 @@ func NewApp(appConfig *config.App) (*App, error) {
 	return app, nil
 }
 
-func (a *App) NewResolver() (resolver.Resolver, error) {
+func (a *App) NewResolver() (_ *resolvers.HIP5Resolver, err error) {
 	rs, err := resolver.NewStub(a.usrConfig.RecursiveAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	hip5 := resolvers.NewHIP5Resolver(rs, a.usrConfig.RootAddr, a.proc.Synced)
+	qmin, err := resolvers.ParseQNAMEMinimisation(a.usrConfig.QNAMEMinimisation)
+	if err != nil {
+		return nil, err
+	}
+
+	syncCheck := a.syncCheck
+	if syncCheck == nil {
+		syncCheck = a.proc.Synced
+	}
+
+	hip5 := resolvers.NewHIP5Resolver(rs, a.usrConfig.RootAddr, syncCheck)
+	defer func() {
+		// stop cache sweepers if setup fails
+		if err != nil {
+			hip5.Close()
+		}
+	}()
+
+	hip5.SetQNAMEMinimisation(qmin)
+	hip5.SetQueryBudget(a.usrConfig.QueryBudget())
+	hip5.SetSyncWait(a.usrConfig.SyncWait, a.usrConfig.SyncWaitQueue)
+	if z, err := resolvers.NewLocalZone(path.Join(a.config.Path, localZoneFileName), a.usrConfig.LocalZoneTrusted); err != nil {
+		log.Printf("[WARN] app: %v", err)
+	} else {
+		hip5.SetLocalZone(z)
+	}
+
+	if len(a.usrConfig.ForwardZones) > 0 {
+		var anchors resolvers.TrustAnchors
+		if name := a.usrConfig.ForwardTrustAnchors; name != "" {
+			if anchors, err = resolvers.ReadTrustAnchors(path.Join(a.config.Path, name)); err != nil {
+				return nil, err
+			}
+		}
+
+		var rules []resolvers.ForwardRule
+		for _, rule := range a.usrConfig.ForwardZones {
+			if rule = strings.TrimSpace(rule); rule == "" {
+				continue
+			}
+
+			r, err := resolvers.ParseForwardRule(rule, anchors)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, r)
+		}
+		hip5.SetForwardRules(rules)
+	}
+
+	var rpzPaths []string
+	for _, name := range a.usrConfig.RPZZones {
+		if name = strings.TrimSpace(name); name != "" {
+			rpzPaths = append(rpzPaths, path.Join(a.config.Path, name))
+		}
+	}
+	if len(rpzPaths) > 0 {
+		policies := resolvers.NewPolicyZones(rpzPaths)
+		if err := policies.Reload(); err != nil {
+			log.Printf("[WARN] app: %v", err)
+		}
+		hip5.SetPolicyZones(policies)
+		a.config.Debug.SetRPZStats(policies.Stats)
+		a.config.ReloadPolicies = policies.Reload
+	}
+
 	ethExt, err := resolvers.NewEthereum(a.usrConfig.EthereumEndpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	// Register HIP-5 handlers
-	hip5.RegisterHandler("_eth", ethExt.Handler)
+	dohExt := resolvers.NewDoHExtension(a.usrConfig.RootAddr)
+
+	cacheConfig := a.usrConfig.CacheConfig()
+	hip5.SetCacheConfig(cacheConfig)
+	ethExt.SetCacheConfig(cacheConfig)
+	dohExt.SetCacheConfig(cacheConfig)
+	hip5.SetServeStale(a.usrConfig.MaxStale)
+	ethExt.SetServeStale(a.usrConfig.MaxStale)
+
+	// caches are saved back on close
+	if a.usrConfig.PersistCache {
+		if err := hip5.SetCacheFile(path.Join(a.config.Path, hip5CacheFileName)); err != nil {
+			log.Printf("[WARN] app: %v", err)
+		}
+		if err := ethExt.SetCacheFile(path.Join(a.config.Path, ensCacheFileName)); err != nil {
+			log.Printf("[WARN] app: %v", err)
+		}
+	}
+	cacheStats := func() map[string]resolvers.CacheStats {
+		stats := hip5.CacheStats()
+		for name, s := range ethExt.CacheStats() {
+			stats[name] = s
+		}
+		return stats
+	}
+	a.config.Debug.SetCacheStats(cacheStats)
+
+	metrics := resolvers.NewMetrics()
+	metrics.SetCacheStats(cacheStats)
+	metrics.SetProcStats(func() resolvers.ProcStats {
+		return resolvers.ProcStats{
+			Height:   a.proc.GetHeight(),
+			Synced:   a.proc.Synced(),
+			Restarts: a.proc.Restarts(),
+		}
+	})
+	hip5.SetMetrics(metrics)
+	ethExt.SetMetrics(metrics)
+	dohExt.SetMetrics(metrics)
+	a.config.Metrics = metrics
+
+	// kept to stop background work on stop
+	a.mu.Lock()
+	a.resolver = hip5
+	a.ethereum = ethExt
+	a.doh = dohExt
+	a.mu.Unlock()
+
+	// Register built-in HIP-5 extensions
+	// others are added with resolvers.RegisterExtension
+	hip5.RegisterExtension(ethExt)
+	hip5.RegisterExtension(dohExt)
+	for _, name := range a.usrConfig.DisabledExtensions {
+		hip5.Extensions().SetEnabled(strings.TrimSpace(name), false)
+	}
+	a.config.Debug.SetExtensionStatus(func() map[string]resolvers.ExtensionStatus {
+		return hip5.Extensions().Status(context.Background())
+	})
 	hip5.SetQueryMiddleware(a.config.Debug.GetDNSProbeMiddleware())
-	a.config.Debug.SetCheckSynced(a.proc.Synced)
+	a.config.Debug.SetCheckSynced(syncCheck)
 
 	return hip5, nil
 }
 
 func (a *App) listen() error {
+	if a.dnsServer != nil {
+		if err := a.dnsServer.Start(); err != nil {
+			return fmt.Errorf("dns server failed: %v", err)
+		}
+	}
+
 	return a.server.ListenAndServe()
 }
 
 func (a *App) stop() {
 	a.proc.Stop()
 	a.server.Close()
+	if a.dnsServer != nil {
+		a.dnsServer.Close()
+	}
+	a.closeResolvers()
 
 	// on stop create a new server
 	// to reset any state like old cache ... etc.
@@ -368,13 +523,47 @@ func (a *App) stop() {
 	}
 }
 
+// closeResolvers saves caches and stops
+// background work of the current resolvers
+func (a *App) closeResolvers() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.resolver.Close()
+	a.ethereum.Close()
+	a.doh.Close()
+}
+
+// clearNegativeCache forgets TLDs without
+// hip-5 records of the current resolver
+func (a *App) clearNegativeCache() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.resolver != nil {
+		a.resolver.ClearNegativeCache()
+	}
+}
+
 func (a *App) newProxyServer() (*http.Server, error) {
 	var err error
+	var hip5 *resolvers.HIP5Resolver
 
 	// add a new resolver to the proxy config
-	if a.config.Proxy.Resolver, err = a.NewResolver(); err != nil {
+	if hip5, err = a.NewResolver(); err != nil {
 		return nil, err
 	}
+	a.config.Proxy.Resolver = hip5
+	a.config.DoH = resolvers.NewDoHHandler(hip5.DefaultResolver.Query)
+	a.config.Trace = hip5.Trace
+	a.config.NeedsSync = hip5.NeedsSync
+
+	// the dns server shares the same resolver
+	// the stub query func is replaced by hip-5
+	a.dnsServer = nil
+	if a.usrConfig.DNSAddr != "" {
+		a.dnsServer = resolvers.NewDNSServer(a.usrConfig.DNSAddr, hip5.DefaultResolver.Query)
+	}
 
 	// initialize a new handler
 	h, err := a.config.Proxy.NewHandler()
@@ -384,7 +573,7 @@ func (a *App) newProxyServer() (*http.Server, error) {
 
 	// copy proxy address from user specified config
 	a.config.ProxyAddr = a.usrConfig.ProxyAddr
-	server := &http.Server{Addr: a.config.ProxyAddr, Handler: h}
+	server := &http.Server{Addr: a.config.ProxyAddr, Handler: a.config.WaitForSync(h)}
 	return server, nil
 }
 
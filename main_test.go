@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fingertip/internal/config"
+	"fingertip/internal/resolvers/proc"
+	"fingertip/internal/resolvers/resolverstest"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestNewResolverEndToEnd(t *testing.T) {
+	h, err := resolverstest.NewHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	example, err := resolverstest.NewZone("example.", "www 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AddRecursive(example)
+
+	z, err := resolverstest.NewZone("test.",
+		"www 300 IN A 192.0.2.2",
+		"alias 300 IN CNAME www.example.",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Sign(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddHIP5(z); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	usrConfig, err := config.ReadUserConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usrConfig.RootAddr = h.Root.Addr
+	usrConfig.RecursiveAddr = h.Recursive.Addr
+	usrConfig.PersistCache = false
+
+	hnsProc, err := proc.NewHNSProc(dir, usrConfig.RootAddr, usrConfig.RecursiveAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{
+		proc:      hnsProc,
+		config:    &config.App{Path: dir},
+		usrConfig: &usrConfig,
+		syncCheck: func() bool {
+			return true
+		},
+	}
+
+	hip5, err := a.NewResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.closeResolvers()
+	hip5.RegisterExtension(h.Extension())
+	h.Use(hip5)
+
+	tests := []struct {
+		name   string
+		want   string
+		secure bool
+	}{
+		{"www.example.", "192.0.2.1", false},
+		{"www.test.", "192.0.2.2", true},
+		// insecure once the chain leaves the zone
+		{"alias.test.", "192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		res := hip5.Query(context.Background(), test.name, dns.TypeA)
+		if res.Err != nil {
+			t.Fatalf("%s: %v", test.name, res.Err)
+		}
+
+		if res.Secure != test.secure {
+			t.Fatalf("%s: got secure = %v, want %v", test.name, res.Secure, test.secure)
+		}
+
+		if len(res.Records) == 0 || res.Records[len(res.Records)-1].(*dns.A).A.String() != test.want {
+			t.Fatalf("%s: got %v, want A %s", test.name, res.Records, test.want)
+		}
+	}
+}